@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/QQGoblin/extrootfs/pkg/driver"
+	"github.com/QQGoblin/extrootfs/pkg/image/diskimg"
+	"github.com/QQGoblin/extrootfs/pkg/image/extimg"
+	"github.com/QQGoblin/extrootfs/pkg/image/treedigest"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
+)
+
+const imageUsage = `Usage: extrootfs [flags] image <command> [options]
+
+Commands:
+  commit    commit a qemu rootfs overlay into a new base image
+  build     build an external image from an OCI layout or docker-archive
+  build-disk
+            build a qemu base image with a file system from an OCI layout or docker-archive
+  digest    compute the content digest of a rootfs in an image, a directory or a device
+`
+
+func runImage(args []string) {
+
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, imageUsage)
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "commit":
+		runImageCommit(args[1:])
+	case "build":
+		runImageBuild(args[1:])
+	case "build-disk":
+		runImageBuildDisk(args[1:])
+	case "digest":
+		runImageDigest(args[1:])
+	default:
+		fmt.Fprint(os.Stderr, imageUsage)
+		os.Exit(2)
+	}
+}
+
+func runImageCommit(args []string) {
+
+	var (
+		volume string
+		name   string
+	)
+
+	fs := flag.NewFlagSet("image commit", flag.ExitOnError)
+	fs.StringVar(&basePath, "base", basePath, "extrootfs data path.")
+	fs.StringVar(&volume, "volume", "", "volume id of the rootfs to commit.")
+	fs.StringVar(&name, "name", "", "name of the new image.")
+	_ = fs.Parse(args)
+
+	if volume == "" || name == "" {
+		klog.Exitf("--volume and --name are required")
+	}
+
+	manifest, err := driver.CommitRootFS(volume, basePath, name)
+	if err != nil {
+		klog.Exitf("commit rootfs %s failed: %v", volume, err)
+	}
+
+	printJSON(manifest)
+}
+
+func runImageBuild(args []string) {
+
+	var opts extimg.Options
+
+	fs := flag.NewFlagSet("image build", flag.ExitOnError)
+	fs.StringVar(&opts.Input, "input", "", "OCI layout directory/tarball or docker-archive tarball of the image.")
+	fs.StringVar(&opts.Ref, "ref", "", "name of the image, required when the input contains multiple images.")
+	fs.StringVar(&opts.MetaRef, "meta-ref", "", "name of the metadata image, defaults to <ref>-meta.")
+	fs.StringVar(&opts.MetaLayer, "meta-layer", "", "layer tarball of the metadata image, defaults to a built-in layer.")
+	fs.StringVar(&opts.Output, "output", "build", "output directory.")
+	_ = fs.Parse(args)
+
+	if opts.Input == "" {
+		klog.Exitf("--input is required")
+	}
+
+	config, err := extimg.Build(opts)
+	if err != nil {
+		klog.Exitf("build external image from %s failed: %v", opts.Input, err)
+	}
+
+	printJSON(config)
+}
+
+func runImageBuildDisk(args []string) {
+
+	var (
+		opts diskimg.Options
+		size string
+	)
+
+	fs := flag.NewFlagSet("image build-disk", flag.ExitOnError)
+	fs.StringVar(&basePath, "base", basePath, "extrootfs data path.")
+	fs.StringVar(&opts.Input, "input", "", "OCI layout directory/tarball or docker-archive tarball of the image.")
+	fs.StringVar(&opts.Ref, "ref", "", "name of the image, required when the input contains multiple images.")
+	fs.StringVar(&opts.Name, "name", "", "name of the new image.")
+	fs.StringVar(&size, "size", "10Gi", "size of the disk image.")
+	fs.StringVar(&opts.FileSystemType, "fs-type", diskimg.FileSystemExt4, "file system of the disk image, ext4 or xfs.")
+	fs.StringVar(&opts.Format, "format", diskimg.FormatQcow2, "format of the disk image, qcow2 or raw.")
+	_ = fs.Parse(args)
+
+	if opts.Input == "" || opts.Name == "" {
+		klog.Exitf("--input and --name are required")
+	}
+
+	quantity, err := resource.ParseQuantity(size)
+	if err != nil {
+		klog.Exitf("invalid size %s: %v", size, err)
+	}
+	opts.Size = quantity.Value()
+
+	manifest, err := diskimg.Build(driver.NewImageStore(basePath), opts)
+	if err != nil {
+		klog.Exitf("build disk image from %s failed: %v", opts.Input, err)
+	}
+
+	printJSON(manifest)
+}
+
+func runImageDigest(args []string) {
+
+	var (
+		input  string
+		ref    string
+		dir    string
+		device string
+		fsType string
+	)
+
+	fs := flag.NewFlagSet("image digest", flag.ExitOnError)
+	fs.StringVar(&input, "input", "", "OCI layout directory/tarball or docker-archive tarball of the image.")
+	fs.StringVar(&ref, "ref", "", "name of the image, required when the input contains multiple images.")
+	fs.StringVar(&dir, "dir", "", "directory of the rootfs.")
+	fs.StringVar(&device, "device", "", "block device of the rootfs, mounted read-only.")
+	fs.StringVar(&fsType, "fs-type", "", "file system of the device, detected by mount if empty.")
+	_ = fs.Parse(args)
+
+	var (
+		digest string
+		err    error
+	)
+	temp := fmt.Sprintf("%s/.extrootfs-digest-%d", os.TempDir(), os.Getpid())
+	switch {
+	case input != "":
+		digest, err = treedigest.FromImage(input, ref, temp)
+	case dir != "":
+		digest, err = treedigest.FromDir(dir)
+	case device != "":
+		digest, err = treedigest.FromDevice(device, fsType, temp)
+	default:
+		klog.Exitf("one of --input, --dir or --device is required")
+	}
+	if err != nil {
+		klog.Exitf("compute content digest failed: %v", err)
+	}
+
+	fmt.Println(digest)
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		klog.Exitf("encode output failed: %v", err)
+	}
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"flag"
 	"github.com/QQGoblin/extrootfs/pkg/driver"
+	"github.com/QQGoblin/extrootfs/pkg/image"
 	"k8s.io/klog/v2"
+	"time"
 )
 
 var (
@@ -13,6 +15,12 @@ var (
 	basePath            string
 	outputBase          string
 	skipCreateAndDelete bool
+	imageSource         string
+	imageGCPolicy       image.GCPolicy
+	prepullConfigMap    string
+	imagePublicKey      string
+	forceDetachGrace    time.Duration
+	arrayConfig         string
 )
 
 func init() {
@@ -23,6 +31,15 @@ func init() {
 	flag.StringVar(&basePath, "base", "/opt/extrootfs", "default endpoint.")
 	flag.StringVar(&outputBase, "output", "/opt/extrootfs/output", "output for message.")
 	flag.BoolVar(&skipCreateAndDelete, "skip-create-and-delete", false, "skip create and delete rootfs")
+	flag.StringVar(&imageSource, "image-source", "", "source to pull missing qemu images from, http(s)://<url> or oci://<registry>/<repository>.")
+	flag.DurationVar(&imageGCPolicy.Interval, "image-gc-interval", 0, "interval of garbage collection of qemu images pulled from --image-source, 0 to disable.")
+	flag.DurationVar(&imageGCPolicy.MinAge, "image-gc-min-age", 24*time.Hour, "minimum age of an unused qemu image before it is garbage collected.")
+	flag.IntVar(&imageGCPolicy.HighThresholdPercent, "image-gc-high-threshold", 85, "disk usage percent above which unused qemu images are always garbage collected, 0 to disable.")
+	flag.IntVar(&imageGCPolicy.LowThresholdPercent, "image-gc-low-threshold", 80, "disk usage percent to which image garbage collection attempts to free.")
+	flag.StringVar(&prepullConfigMap, "prepull-configmap", "", "<namespace>/<name> of the ConfigMap listing qemu images to pre-pull onto nodes.")
+	flag.StringVar(&imagePublicKey, "image-public-key", "", "PEM public key to verify detached signatures of qemu images, empty to disable signature verification.")
+	flag.DurationVar(&forceDetachGrace, "force-detach-grace-period", 0, "force to disconnect a rootfs device still in use after this period, 0 to never force.")
+	flag.StringVar(&arrayConfig, "array-config", "", "JSON file of storage arrays to provision iscsi LUNs on, empty to disable.")
 	klog.InitFlags(nil)
 
 	if err := flag.Set("logtostderr", "true"); err != nil {
@@ -34,6 +51,11 @@ func init() {
 
 func main() {
 
-	driver := driver.NewDriver(drivername, nodeid, endpoint, basePath, outputBase, !skipCreateAndDelete)
+	if flag.NArg() > 0 && flag.Arg(0) == "image" {
+		runImage(flag.Args()[1:])
+		return
+	}
+
+	driver := driver.NewDriver(drivername, nodeid, endpoint, basePath, outputBase, imageSource, imagePublicKey, imageGCPolicy, prepullConfigMap, forceDetachGrace, arrayConfig, !skipCreateAndDelete)
 	driver.Run()
 }
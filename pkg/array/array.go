@@ -0,0 +1,102 @@
+package array
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	TypeLIO = "lio"
+)
+
+// ErrMapped LUN 已经授权给其他节点
+var ErrMapped = errors.New("lun is mapped to other initiators")
+
+// Volume 是存储阵列上的一个 LUN 以及访问它的 iSCSI 信息
+type Volume struct {
+	Name   string `json:"name"`
+	Target string `json:"target"`
+	Portal string `json:"portal"`
+	Lun    int    `json:"lun"`
+	Size   int64  `json:"size"`
+}
+
+// Array 管理存储阵列上的 LUN
+type Array interface {
+	// CreateVolume 创建 LUN，source 不为空时从同一阵列上的 golden LUN 或者其他卷克隆。
+	// LUN 已经存在时返回已有的 LUN，大小不小于 size。
+	CreateVolume(name string, size int64, source string) (*Volume, error)
+	// DeleteVolume 删除 LUN，LUN 不存在时返回 nil
+	DeleteVolume(name string) error
+	// Expand 将 LUN 扩大到不小于 size，返回 LUN 实际的大小
+	Expand(name string, size int64) (int64, error)
+	// Map 允许节点的 initiator 访问 LUN 并记录节点的 initiator，readOnly 时 initiator 只能读取。
+	// exclusive 时 LUN 已经授权给配置之外的其他 initiator 则返回 ErrMapped。
+	Map(name, node, initiator string, readOnly, exclusive bool) error
+	// Unmap 撤销 Map 时记录的节点 initiator 对 LUN 的访问，node 为空时撤销配置之外的所有 initiator
+	Unmap(name, node string) error
+}
+
+// Config 存储阵列的配置
+type Config struct {
+	Type string `json:"type"`
+	// Host 管理阵列的主机，<user>@<host>，为空时在本机执行
+	Host   string `json:"host"`
+	SSHKey string `json:"ssh_key"`
+	// Portal 节点访问阵列的 iSCSI portal，<ip>:<port>
+	Portal  string `json:"portal"`
+	BaseIQN string `json:"base_iqn"`
+	// Dir 阵列主机上保存 LUN 文件的目录
+	Dir string `json:"dir"`
+	// Initiators 创建 LUN 时即允许访问的 initiator，其他节点在 ControllerPublishVolume 时授权
+	Initiators []string `json:"initiators"`
+}
+
+var nameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]*$`)
+
+// ValidateName 检查阵列和 LUN 的名称，名称会用于 IQN 和阵列主机上的文件名
+func ValidateName(name string) error {
+	if !nameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid name %q, must consist of lower case alphanumeric characters, '-' or '.'", name)
+	}
+	return nil
+}
+
+// New 根据配置创建存储阵列
+func New(config Config) (Array, error) {
+	switch config.Type {
+	case TypeLIO:
+		return newLIO(config)
+	}
+	return nil, fmt.Errorf("unsupported array type %q", config.Type)
+}
+
+// Load 从配置文件读取所有存储阵列，配置文件为阵列名称到配置的 JSON 对象
+func Load(file string) (map[string]Array, error) {
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "load array config")
+	}
+
+	configs := make(map[string]Config)
+	if err = json.Unmarshal(b, &configs); err != nil {
+		return nil, errors.Wrapf(err, "parse array config %s", file)
+	}
+
+	arrays := make(map[string]Array, len(configs))
+	for name, config := range configs {
+		if err = ValidateName(name); err != nil {
+			return nil, errors.Wrap(err, "load array config")
+		}
+		if arrays[name], err = New(config); err != nil {
+			return nil, errors.Wrapf(err, "array %s", name)
+		}
+	}
+
+	return arrays, nil
+}
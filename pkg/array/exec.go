@@ -0,0 +1,43 @@
+package array
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+
+	"github.com/QQGoblin/extrootfs/pkg/utils/log"
+	"github.com/pkg/errors"
+)
+
+// executor 在阵列主机上执行 shell 脚本，Host 为空时在本机执行，否则通过 ssh 执行
+type executor struct {
+	host   string
+	sshKey string
+}
+
+func (e *executor) run(script string) (string, error) {
+
+	var cmd *exec.Cmd
+	if e.host == "" {
+		cmd = exec.Command("sh", "-s")
+	} else {
+		args := []string{"-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=accept-new"}
+		if e.sshKey != "" {
+			args = append(args, "-i", e.sshKey)
+		}
+		args = append(args, e.host, "sh", "-s")
+		cmd = exec.Command("ssh", args...)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = strings.NewReader(script)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	log.DebugLogMsg("Run on array host %q: %s", e.host, script)
+	if err := cmd.Run(); err != nil {
+		return "", errors.Wrapf(err, "run on array host %q: %s", e.host, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
@@ -0,0 +1,355 @@
+package array
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	lioDefaultDir = "/var/lib/extrootfs"
+	lioLun        = 0
+	lioConfigFS   = "/sys/kernel/config/target/iscsi"
+)
+
+var initiatorRegexp = regexp.MustCompile(`^(iqn\.[0-9]{4}-[0-9]{2}\.[a-zA-Z0-9.:-]+|eui\.[0-9a-fA-F]{16})$`)
+
+// lio 通过 targetcli 管理 Linux LIO target。
+// 每个 LUN 是阵列主机上 Dir 目录中的一个 fileio backstore，并且使用独立的 target（<BaseIQN>:<name>），
+// 克隆时复制来源文件，文件系统支持时使用 reflink。
+type lio struct {
+	config Config
+	exec   *executor
+	// configFS 阵列主机上 LIO iSCSI 的 configfs 目录
+	configFS string
+}
+
+func newLIO(config Config) (*lio, error) {
+
+	if config.Portal == "" {
+		return nil, errors.New("portal is required")
+	}
+	if !initiatorRegexp.MatchString(config.BaseIQN) || strings.HasPrefix(config.BaseIQN, "eui.") {
+		return nil, fmt.Errorf("invalid base iqn %q", config.BaseIQN)
+	}
+	if config.Dir == "" {
+		config.Dir = lioDefaultDir
+	}
+	for _, initiator := range config.Initiators {
+		if err := validateInitiator(initiator); err != nil {
+			return nil, err
+		}
+	}
+
+	return &lio{config: config, exec: &executor{host: config.Host, sshKey: config.SSHKey}, configFS: lioConfigFS}, nil
+}
+
+func validateInitiator(initiator string) error {
+	if !initiatorRegexp.MatchString(initiator) {
+		return fmt.Errorf("invalid initiator %q", initiator)
+	}
+	return nil
+}
+
+func (l *lio) target(name string) string {
+	return l.config.BaseIQN + ":" + name
+}
+
+func (l *lio) file(name string) string {
+	return path.Join(l.config.Dir, name+".img")
+}
+
+// nodes 阵列主机上记录已经 attach 的节点 initiator 的目录，每个节点一个文件
+func (l *lio) nodes(name string) string {
+	return path.Join(l.config.Dir, name+".nodes")
+}
+
+func (l *lio) CreateVolume(name string, size int64, source string) (*Volume, error) {
+
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+
+	var create string
+	if source != "" {
+		if err := ValidateName(source); err != nil {
+			return nil, errors.Wrap(err, "source")
+		}
+		src := quote(l.file(source))
+		create = fmt.Sprintf(`[ -e %s ] || { echo "source %s not found" >&2; exit 1; }
+  cp --sparse=always --reflink=auto %s "$file.tmp"`, src, source, src)
+	} else {
+		create = fmt.Sprintf(`truncate -s %d "$file.tmp"`, size)
+	}
+
+	tpg := "/iscsi/" + l.target(name) + "/tpg1"
+	script := fmt.Sprintf(`set -e
+file=%s
+if [ ! -e "$file" ]; then
+  mkdir -p %s
+  %s
+  mv "$file.tmp" "$file"
+fi
+if [ "$(stat -c %%s "$file")" -lt %d ]; then
+  truncate -s %d "$file"
+fi
+targetcli /backstores/fileio/%s ls >/dev/null 2>&1 || targetcli /backstores/fileio create name=%s file_or_dev="$file" write_back=false >/dev/null
+targetcli /iscsi/%s ls >/dev/null 2>&1 || targetcli /iscsi create %s >/dev/null
+targetcli %s/luns/lun%d ls >/dev/null 2>&1 || targetcli %s/luns create /backstores/fileio/%s lun=%d >/dev/null
+%s
+targetcli saveconfig >/dev/null
+stat -c %%s "$file"
+`, quote(l.file(name)), quote(l.config.Dir), create, size, size,
+		name, name, l.target(name), l.target(name), tpg, lioLun, tpg, name, lioLun, l.aclScript(name))
+
+	out, err := l.exec.run(script)
+	if err != nil {
+		return nil, errors.Wrapf(err, "create lun %s", name)
+	}
+
+	actual, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse size of lun %s", name)
+	}
+
+	return &Volume{
+		Name:   name,
+		Target: l.target(name),
+		Portal: l.config.Portal,
+		Lun:    lioLun,
+		Size:   actual,
+	}, nil
+}
+
+// Expand 扩大 LUN 文件，并重新创建 backstore 使 LIO 使用新的大小。
+// fileio backstore 的大小在创建时确定，因此只允许在 LUN 没有授权给其他节点、并且没有任何 iSCSI 会话（离线）时扩容，
+// 重新创建 backstore 期间禁用 tpg，避免 initiator 在此期间登录。
+func (l *lio) Expand(name string, size int64) (int64, error) {
+
+	if err := ValidateName(name); err != nil {
+		return 0, err
+	}
+
+	tpg := "/iscsi/" + l.target(name) + "/tpg1"
+	script := fmt.Sprintf(`set -e
+file=%s
+[ -e "$file" ] || { echo "lun %s not found" >&2; exit 1; }
+%s
+[ -z "$others" ] || { echo "lun %s is mapped to$others" >&2; exit 1; }
+%s
+[ -z "$sessions" ] || { echo "lun %s has active sessions from$sessions" >&2; exit 1; }
+if [ "$(stat -c %%s "$file")" -lt %d ]; then
+  truncate -s %d "$file"
+fi
+targetcli %s disable >/dev/null 2>&1 || true
+trap 'targetcli %s enable >/dev/null 2>&1 || true' EXIT
+if targetcli %s/luns/lun%d ls >/dev/null 2>&1; then
+  targetcli %s/luns delete lun%d >/dev/null
+fi
+if targetcli /backstores/fileio/%s ls >/dev/null 2>&1; then
+  targetcli /backstores/fileio delete %s >/dev/null
+fi
+targetcli /backstores/fileio create name=%s file_or_dev="$file" write_back=false >/dev/null
+targetcli %s/luns create /backstores/fileio/%s lun=%d >/dev/null
+%s
+targetcli %s enable >/dev/null
+trap - EXIT
+targetcli saveconfig >/dev/null
+stat -c %%s "$file"
+`, quote(l.file(name)), name, l.othersScript(name, ""), name, l.sessionsScript(name), name, size, size,
+		tpg, tpg, tpg, lioLun, tpg, lioLun, name, name, name, tpg, name, lioLun, l.aclScript(name), tpg)
+
+	out, err := l.exec.run(script)
+	if err != nil {
+		return 0, errors.Wrapf(err, "expand lun %s", name)
+	}
+
+	actual, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parse size of lun %s", name)
+	}
+
+	return actual, nil
+}
+
+// aclScript 关闭 demo mode，只允许配置的 initiator 访问 target，其他 initiator 由 Map 授权
+func (l *lio) aclScript(name string) string {
+
+	lines := []string{fmt.Sprintf("targetcli /iscsi/%s/tpg1 set attribute generate_node_acls=0 >/dev/null", l.target(name))}
+	for _, initiator := range l.config.Initiators {
+		lines = append(lines, l.mapScript(name, initiator, false))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// mapScript 创建 initiator 的 ACL 以及映射的 LUN，并通过 configfs 设置 LUN 是否写保护
+func (l *lio) mapScript(name, initiator string, readOnly bool) string {
+
+	tpg := "/iscsi/" + l.target(name) + "/tpg1"
+	writeProtect := 0
+	if readOnly {
+		writeProtect = 1
+	}
+
+	return fmt.Sprintf(`targetcli %s/acls/%s ls >/dev/null 2>&1 || targetcli %s/acls create %s add_mapped_luns=false >/dev/null
+targetcli %s/acls/%s/mapped_lun%d ls >/dev/null 2>&1 || targetcli %s/acls/%s create mapped_lun=%d tpg_lun_or_backstore=lun%d write_protect=%d >/dev/null
+echo %d > %s/%s/tpgt_1/acls/%s/lun_%d/write_protect`,
+		tpg, initiator, tpg, initiator,
+		tpg, initiator, lioLun, tpg, initiator, lioLun, lioLun, writeProtect,
+		writeProtect, l.configFS, l.target(name), initiator, lioLun)
+}
+
+func (l *lio) DeleteVolume(name string) error {
+
+	if err := ValidateName(name); err != nil {
+		return err
+	}
+
+	script := fmt.Sprintf(`set -e
+if targetcli /iscsi/%s ls >/dev/null 2>&1; then
+  targetcli /iscsi delete %s >/dev/null
+fi
+if targetcli /backstores/fileio/%s ls >/dev/null 2>&1; then
+  targetcli /backstores/fileio delete %s >/dev/null
+fi
+rm -f %s
+rm -rf %s
+targetcli saveconfig >/dev/null
+`, l.target(name), l.target(name), name, name, quote(l.file(name)), quote(l.nodes(name)))
+
+	if _, err := l.exec.run(script); err != nil {
+		return errors.Wrapf(err, "delete lun %s", name)
+	}
+	return nil
+}
+
+func (l *lio) Map(name, node, initiator string, readOnly, exclusive bool) error {
+
+	if err := ValidateName(name); err != nil {
+		return err
+	}
+	if err := ValidateName(node); err != nil {
+		return err
+	}
+	if err := validateInitiator(initiator); err != nil {
+		return err
+	}
+
+	// 节点的 initiator 变化时先删除原来的 ACL，exclusive 时其他 initiator 已经有 ACL 则不授权
+	tpg := "/iscsi/" + l.target(name) + "/tpg1"
+	record := quote(path.Join(l.nodes(name), node))
+	var check string
+	if exclusive {
+		check = `if [ -n "$others" ]; then
+  echo "mapped:$others"
+  exit 0
+fi`
+	}
+
+	script := fmt.Sprintf(`set -e
+if [ -f %s ]; then
+  old=$(cat %s)
+  if [ "$old" != %s ] && targetcli %s/acls/"$old" ls >/dev/null 2>&1; then
+    targetcli %s/acls delete "$old" >/dev/null
+  fi
+fi
+%s
+%s
+mkdir -p %s
+echo %s > %s
+%s
+targetcli saveconfig >/dev/null
+`, record, record, initiator, tpg, tpg,
+		l.othersScript(name, initiator), check,
+		quote(l.nodes(name)), initiator, record,
+		l.mapScript(name, initiator, readOnly))
+
+	out, err := l.exec.run(script)
+	if err != nil {
+		return errors.Wrapf(err, "map lun %s to %s", name, initiator)
+	}
+	if out = strings.TrimSpace(out); strings.HasPrefix(out, "mapped:") {
+		return errors.Wrapf(ErrMapped, "lun %s is mapped to %s", name, strings.TrimSpace(strings.TrimPrefix(out, "mapped:")))
+	}
+	return nil
+}
+
+func (l *lio) Unmap(name, node string) error {
+
+	if err := ValidateName(name); err != nil {
+		return err
+	}
+
+	tpg := "/iscsi/" + l.target(name) + "/tpg1"
+	if node == "" {
+		return l.unmapAll(name, tpg)
+	}
+
+	if err := ValidateName(node); err != nil {
+		return err
+	}
+
+	record := quote(path.Join(l.nodes(name), node))
+	script := fmt.Sprintf(`set -e
+[ -f %s ] || exit 0
+initiator=$(cat %s)
+if targetcli %s/acls/"$initiator" ls >/dev/null 2>&1; then
+  targetcli %s/acls delete "$initiator" >/dev/null
+  targetcli saveconfig >/dev/null
+fi
+rm -f %s
+`, record, record, tpg, tpg, record)
+
+	if _, err := l.exec.run(script); err != nil {
+		return errors.Wrapf(err, "unmap lun %s from node %s", name, node)
+	}
+	return nil
+}
+
+// unmapAll 删除配置之外的所有 initiator 的 ACL
+func (l *lio) unmapAll(name, tpg string) error {
+
+	script := fmt.Sprintf(`set -e
+%s
+for initiator in $others; do
+  targetcli %s/acls delete "$initiator" >/dev/null
+done
+rm -rf %s
+targetcli saveconfig >/dev/null
+`, l.othersScript(name, ""), tpg, quote(l.nodes(name)))
+
+	if _, err := l.exec.run(script); err != nil {
+		return errors.Wrapf(err, "unmap lun %s", name)
+	}
+	return nil
+}
+
+// othersScript 将配置之外并且不是 except 的 initiator 保存到 shell 变量 others 中
+func (l *lio) othersScript(name, except string) string {
+	return fmt.Sprintf(`others=""
+for acl in %s/%s/tpgt_1/acls/*; do
+  [ -d "$acl" ] || continue
+  initiator=$(basename "$acl")
+  case " %s %s " in *" $initiator "*) continue ;; esac
+  others="$others $initiator"
+done`, l.configFS, l.target(name), strings.Join(l.config.Initiators, " "), except)
+}
+
+// sessionsScript 将有 iSCSI 会话的 initiator 保存到 shell 变量 sessions 中，包括配置中的 initiator
+func (l *lio) sessionsScript(name string) string {
+	return fmt.Sprintf(`sessions=""
+for acl in %s/%s/tpgt_1/acls/*; do
+  [ -f "$acl/info" ] || continue
+  grep -q "No active iSCSI Session" "$acl/info" && continue
+  sessions="$sessions $(basename "$acl")"
+done`, l.configFS, l.target(name))
+}
+
+// quote 将字符串转义为 shell 单引号字符串
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
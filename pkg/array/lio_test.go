@@ -0,0 +1,223 @@
+package array
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	testBaseIQN   = "iqn.2024-01.io.extrootfs"
+	testInitiator = "iqn.2024-01.io.extrootfs:node-1"
+)
+
+// fakeTargetcli 在 PATH 中放置记录参数的 targetcli，返回记录文件
+func fakeTargetcli(t *testing.T) string {
+	t.Helper()
+
+	bin := t.TempDir()
+	record := path.Join(t.TempDir(), "targetcli.log")
+	script := "#!/bin/sh\necho \"$*\" >> " + quote(record) + "\n"
+	if err := os.WriteFile(path.Join(bin, "targetcli"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	return record
+}
+
+func testLIO(t *testing.T, initiators ...string) *lio {
+	t.Helper()
+
+	l, err := newLIO(Config{Type: TypeLIO, Portal: "192.168.0.1:3260", BaseIQN: testBaseIQN, Dir: t.TempDir(), Initiators: initiators})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.configFS = t.TempDir()
+
+	return l
+}
+
+// addACL 在 configfs 中创建 initiator 的 ACL 以及映射的 LUN，session 表示 initiator 是否已经登录
+func addACL(t *testing.T, l *lio, name, initiator string, session bool) {
+	t.Helper()
+
+	acl := path.Join(l.configFS, l.target(name), "tpgt_1", "acls", initiator)
+	if err := os.MkdirAll(path.Join(acl, "lun_0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	info := "No active iSCSI Session for Initiator Endpoint: " + initiator + "\n"
+	if session {
+		info = "InitiatorName: " + initiator + "\nSession State: TARG_SESS_STATE_LOGGED_IN\n"
+	}
+	if err := os.WriteFile(path.Join(acl, "info"), []byte(info), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLIOExpand(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		configured bool
+		session    bool
+		err        string
+	}{
+		{name: "offline", configured: true},
+		{name: "session from configured initiator", configured: true, session: true, err: "active sessions"},
+		{name: "mapped to other initiator", err: "is mapped to"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			record := fakeTargetcli(t)
+			l := testLIO(t, testInitiator)
+			if !tt.configured {
+				l.config.Initiators = nil
+			}
+			addACL(t, l, "pvc-1", testInitiator, tt.session)
+			if err := os.WriteFile(l.file("pvc-1"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Truncate(l.file("pvc-1"), 1<<20); err != nil {
+				t.Fatal(err)
+			}
+
+			size, err := l.Expand("pvc-1", 2<<20)
+			b, _ := os.ReadFile(record)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Expand error = %v, want %q", err, tt.err)
+				}
+				if strings.Contains(string(b), "delete") {
+					t.Errorf("backstore is deleted when expand is refused:\n%s", b)
+				}
+				if info, _ := os.Stat(l.file("pvc-1")); info.Size() != 1<<20 {
+					t.Errorf("lun file size = %d, want %d", info.Size(), 1<<20)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Expand: %v", err)
+			}
+			if size != 2<<20 {
+				t.Errorf("Expand size = %d, want %d", size, 2<<20)
+			}
+			tpg := "/iscsi/" + l.target("pvc-1") + "/tpg1"
+			for _, cmd := range []string{tpg + " disable", "/backstores/fileio create name=pvc-1", tpg + " enable"} {
+				if !strings.Contains(string(b), cmd) {
+					t.Errorf("targetcli %q is not called:\n%s", cmd, b)
+				}
+			}
+		})
+	}
+}
+
+func TestLIOMap(t *testing.T) {
+
+	const (
+		configured = "iqn.2024-01.io.extrootfs:controller"
+		other      = "iqn.2024-01.io.extrootfs:node-2"
+	)
+
+	tests := []struct {
+		name      string
+		acls      []string
+		readOnly  bool
+		exclusive bool
+		mapped    bool
+	}{
+		{name: "exclusive", acls: []string{testInitiator, configured}, exclusive: true},
+		{name: "read only", acls: []string{testInitiator, other}, readOnly: true},
+		{name: "exclusive mapped to other", acls: []string{testInitiator, other}, exclusive: true, mapped: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			record := fakeTargetcli(t)
+			l := testLIO(t, configured)
+			for _, initiator := range tt.acls {
+				addACL(t, l, "pvc-1", initiator, false)
+			}
+
+			err := l.Map("pvc-1", "node-1", testInitiator, tt.readOnly, tt.exclusive)
+			nodeRecord := path.Join(l.nodes("pvc-1"), "node-1")
+			if tt.mapped {
+				if !errors.Is(err, ErrMapped) || !strings.Contains(err.Error(), other) {
+					t.Fatalf("Map error = %v, want ErrMapped to %s", err, other)
+				}
+				if _, err = os.Stat(nodeRecord); !os.IsNotExist(err) {
+					t.Errorf("node record is written when mapping is refused: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Map: %v", err)
+			}
+
+			if b, err := os.ReadFile(nodeRecord); err != nil || strings.TrimSpace(string(b)) != testInitiator {
+				t.Errorf("node record = %q (%v), want %s", b, err, testInitiator)
+			}
+			want := "0"
+			if tt.readOnly {
+				want = "1"
+			}
+			writeProtect := path.Join(l.configFS, l.target("pvc-1"), "tpgt_1", "acls", testInitiator, "lun_0", "write_protect")
+			if b, _ := os.ReadFile(writeProtect); strings.TrimSpace(string(b)) != want {
+				t.Errorf("write_protect = %q, want %s", b, want)
+			}
+			if b, _ := os.ReadFile(record); !strings.Contains(string(b), "saveconfig") {
+				t.Errorf("targetcli saveconfig is not called:\n%s", b)
+			}
+		})
+	}
+}
+
+func TestLIOUnmap(t *testing.T) {
+
+	const other = "iqn.2024-01.io.extrootfs:node-2"
+
+	record := fakeTargetcli(t)
+	l := testLIO(t)
+	for _, initiator := range []string{testInitiator, other} {
+		addACL(t, l, "pvc-1", initiator, false)
+	}
+	for node, initiator := range map[string]string{"node-1": testInitiator, "node-2": other} {
+		if err := l.Map("pvc-1", node, initiator, false, false); err != nil {
+			t.Fatalf("Map %s: %v", node, err)
+		}
+	}
+
+	tpg := "/iscsi/" + l.target("pvc-1") + "/tpg1"
+	if err := l.Unmap("pvc-1", "node-1"); err != nil {
+		t.Fatalf("Unmap: %v", err)
+	}
+	if _, err := os.Stat(path.Join(l.nodes("pvc-1"), "node-1")); !os.IsNotExist(err) {
+		t.Errorf("node-1 record is not removed: %v", err)
+	}
+	if b, _ := os.ReadFile(record); !strings.Contains(string(b), tpg+"/acls delete "+testInitiator) {
+		t.Errorf("acl of node-1 is not deleted:\n%s", b)
+	}
+
+	// 没有记录的节点直接返回
+	if err := l.Unmap("pvc-1", "node-3"); err != nil {
+		t.Errorf("Unmap node without record: %v", err)
+	}
+
+	// 不指定节点时撤销所有 ACL
+	if err := l.Unmap("pvc-1", ""); err != nil {
+		t.Fatalf("Unmap all: %v", err)
+	}
+	if _, err := os.Stat(l.nodes("pvc-1")); !os.IsNotExist(err) {
+		t.Errorf("node records are not removed: %v", err)
+	}
+	if b, _ := os.ReadFile(record); !strings.Contains(string(b), tpg+"/acls delete "+other) {
+		t.Errorf("acl of node-2 is not deleted:\n%s", b)
+	}
+}
@@ -0,0 +1,88 @@
+package driver
+
+import (
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// rootfsAccessModes 各类型 rootfs 支持的访问模式。
+// qemu overlay 只能被一个节点上的 qemu-nbd 导出；iscsi LUN 只读时可以被多个节点同时挂载。
+// 驱动声明了 SINGLE_NODE_MULTI_WRITER，CO 会将 ReadWriteOnce 转换为 SINGLE_NODE_MULTI_WRITER。
+var rootfsAccessModes = map[string][]csi.VolumeCapability_AccessMode_Mode{
+	RootfsTypeQemu: {
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+	},
+	RootfsTypeISCSI: {
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+	},
+}
+
+// supportedAccessModes 返回所有类型 rootfs 支持的访问模式
+func supportedAccessModes() []csi.VolumeCapability_AccessMode_Mode {
+	var modes []csi.VolumeCapability_AccessMode_Mode
+	seen := make(map[csi.VolumeCapability_AccessMode_Mode]bool)
+	for _, rootfsType := range []string{RootfsTypeQemu, RootfsTypeISCSI} {
+		for _, mode := range rootfsAccessModes[rootfsType] {
+			if !seen[mode] {
+				seen[mode] = true
+				modes = append(modes, mode)
+			}
+		}
+	}
+	return modes
+}
+
+// validateAccessModes 检查 rootfs 类型是否支持请求的访问类型和访问模式
+func validateAccessModes(rootfsType string, capabilities []*csi.VolumeCapability) error {
+
+	modes, ok := rootfsAccessModes[rootfsType]
+	if !ok {
+		return status.Errorf(codes.InvalidArgument, "error rootfs type %s", rootfsType)
+	}
+
+	for _, capability := range capabilities {
+		if err := validateVolumeCapability(capability); err != nil {
+			return err
+		}
+		mode := capability.GetAccessMode().GetMode()
+		if !containsAccessMode(modes, mode) {
+			return status.Errorf(codes.InvalidArgument, "access mode %s is not supported by %s rootfs", mode, rootfsType)
+		}
+	}
+
+	return nil
+}
+
+func containsAccessMode(modes []csi.VolumeCapability_AccessMode_Mode, mode csi.VolumeCapability_AccessMode_Mode) bool {
+	for _, m := range modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// isReadOnlyMode 判断访问模式是否只读，只读的 rootfs 以只读方式连接设备
+func isReadOnlyMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	return mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY ||
+		mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+}
+
+// isMultiNode 判断访问模式是否允许多个节点同时使用
+func isMultiNode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	switch mode {
+	case csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+		return true
+	}
+	return false
+}
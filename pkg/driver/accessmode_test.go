@@ -0,0 +1,82 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// coAccessMode 按照 external-provisioner 和 kubelet 的规则将 PV 的访问模式转换为 CSI 访问模式，
+// 驱动声明了 SINGLE_NODE_MULTI_WRITER 时使用 SINGLE_NODE_* 细分模式
+func coAccessMode(pvMode string, multiWriter bool) csi.VolumeCapability_AccessMode_Mode {
+	switch pvMode {
+	case "ReadWriteOnce":
+		if multiWriter {
+			return csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER
+		}
+		return csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER
+	case "ReadWriteOncePod":
+		if multiWriter {
+			return csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER
+		}
+		return csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER
+	case "ReadOnlyMany":
+		return csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+	}
+	return csi.VolumeCapability_AccessMode_UNKNOWN
+}
+
+func TestAccessModesFromCO(t *testing.T) {
+
+	controllerMultiWriter := false
+	for _, c := range controllerCapabilities(true) {
+		if c == csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER {
+			controllerMultiWriter = true
+		}
+	}
+	nodeMultiWriter := false
+	for _, c := range nodeCapabilities {
+		if c == csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER {
+			nodeMultiWriter = true
+		}
+	}
+
+	tests := []struct {
+		rootfsType string
+		pvMode     string
+		supported  bool
+	}{
+		{RootfsTypeQemu, "ReadWriteOnce", true},
+		{RootfsTypeQemu, "ReadWriteOncePod", true},
+		{RootfsTypeQemu, "ReadOnlyMany", false},
+		{RootfsTypeISCSI, "ReadWriteOnce", true},
+		{RootfsTypeISCSI, "ReadWriteOncePod", true},
+		{RootfsTypeISCSI, "ReadOnlyMany", true},
+	}
+
+	for _, tt := range tests {
+		// CreateVolume 使用控制器的能力，NodeStageVolume 使用节点的能力
+		for service, multiWriter := range map[string]bool{"controller": controllerMultiWriter, "node": nodeMultiWriter} {
+			mode := coAccessMode(tt.pvMode, multiWriter)
+			capability := &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+			}
+			err := validateAccessModes(tt.rootfsType, []*csi.VolumeCapability{capability})
+			if (err == nil) != tt.supported {
+				t.Errorf("%s %s %s (%s): got error %v, want supported %t", service, tt.rootfsType, tt.pvMode, mode, err, tt.supported)
+			}
+		}
+	}
+}
+
+func TestSupportedAccessModesAdvertised(t *testing.T) {
+
+	// 驱动声明的访问模式需要包含 CO 可能发送的所有模式
+	modes := supportedAccessModes()
+	for _, pvMode := range []string{"ReadWriteOnce", "ReadWriteOncePod", "ReadOnlyMany"} {
+		if mode := coAccessMode(pvMode, true); !containsAccessMode(modes, mode) {
+			t.Errorf("%s (%s) is not in supported access modes %v", pvMode, mode, modes)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package driver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/QQGoblin/extrootfs/pkg/array"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// arrayKey 指定创建 iscsi LUN 的存储阵列，对应 --array-config 中的阵列名称
+	arrayKey = "extrootfs.io/array"
+	// arraySourceKey 创建 LUN 时克隆的 golden LUN
+	arraySourceKey = "extrootfs.io/array/source"
+
+	// 阵列上的卷 ID 为 array:<阵列名称>:<LUN 名称>，DeleteVolume 只能通过卷 ID 找到阵列。
+	// 阵列和 LUN 的名称中不会出现 ':'，手动创建的卷不会使用这个前缀。
+	arrayVolumeIDPrefix    = "array:"
+	arrayVolumeIDSeparator = ":"
+)
+
+func arrayVolumeID(name, arrayName string) string {
+	return arrayVolumeIDPrefix + arrayName + arrayVolumeIDSeparator + name
+}
+
+// isArrayVolumeID 判断卷是否由阵列创建
+func isArrayVolumeID(id string) bool {
+	return strings.HasPrefix(id, arrayVolumeIDPrefix)
+}
+
+// parseArrayVolumeID 返回 LUN 名称和阵列名称
+func parseArrayVolumeID(id string) (string, string, error) {
+	arrayName, name, ok := strings.Cut(strings.TrimPrefix(id, arrayVolumeIDPrefix), arrayVolumeIDSeparator)
+	if !isArrayVolumeID(id) || !ok || array.ValidateName(arrayName) != nil || array.ValidateName(name) != nil {
+		return "", "", fmt.Errorf("invalid array volume id %s", id)
+	}
+	return name, arrayName, nil
+}
+
+// createArrayVolume 在存储阵列上创建 LUN，并将 LUN 的 iscsi 信息写入 volume context
+func (cs *ControllerServer) createArrayVolume(request *csi.CreateVolumeRequest, parameters map[string]string) (*csi.Volume, error) {
+
+	arrayName := parameters[arrayKey]
+	a, ok := cs.arrays[arrayName]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "array %s is not configured", arrayName)
+	}
+
+	name := request.GetName()
+	if err := array.ValidateName(name); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	source := parameters[arraySourceKey]
+	if sourceVolume := request.GetVolumeContentSource().GetVolume(); sourceVolume != nil {
+		lun, sourceArray, err := parseArrayVolumeID(sourceVolume.GetVolumeId())
+		if err != nil || sourceArray != arrayName {
+			return nil, status.Errorf(codes.InvalidArgument, "source volume %s is not on array %s", sourceVolume.GetVolumeId(), arrayName)
+		}
+		source = lun
+	}
+
+	id := arrayVolumeID(name, arrayName)
+	if acquired := cs.rootfsLock.TryAcquire(id); !acquired {
+		return nil, status.Errorf(codes.Aborted, "an operation with the given Volume ID %s already exists", id)
+	}
+	defer cs.rootfsLock.Release(id)
+
+	vol, err := a.CreateVolume(name, request.GetCapacityRange().GetRequiredBytes(), source)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Create LUN %s on array %s failed: %v", name, arrayName, err)
+	}
+
+	parameters[iscsiTargetKey] = vol.Target
+	parameters[iscsiPortalKey] = vol.Portal
+	parameters[iscsiLunKey] = strconv.Itoa(vol.Lun)
+
+	return &csi.Volume{
+		VolumeId:      id,
+		CapacityBytes: vol.Size,
+		VolumeContext: parameters,
+		ContentSource: request.GetVolumeContentSource(),
+	}, nil
+}
+
+// expandArrayVolume 在阵列上扩容 LUN，不是阵列上的卷时返回 false
+func (cs *ControllerServer) expandArrayVolume(volumeID string, size int64) (bool, int64, error) {
+
+	if !isArrayVolumeID(volumeID) {
+		return false, 0, nil
+	}
+
+	name, arrayName, err := parseArrayVolumeID(volumeID)
+	if err != nil {
+		return true, 0, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	a, ok := cs.arrays[arrayName]
+	if !ok {
+		return true, 0, status.Errorf(codes.FailedPrecondition, "array %s of volume %s is not configured", arrayName, volumeID)
+	}
+
+	capacity, err := a.Expand(name, size)
+	if err != nil {
+		return true, 0, status.Errorf(codes.Internal, "Expand LUN %s on array %s failed: %v", name, arrayName, err)
+	}
+
+	return true, capacity, nil
+}
+
+// deleteArrayVolume 删除阵列上的 LUN，不是阵列上的卷时返回 false
+func (cs *ControllerServer) deleteArrayVolume(volumeID string) (bool, error) {
+
+	if !isArrayVolumeID(volumeID) {
+		return false, nil
+	}
+
+	name, arrayName, err := parseArrayVolumeID(volumeID)
+	if err != nil {
+		return true, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	a, ok := cs.arrays[arrayName]
+	if !ok {
+		return true, status.Errorf(codes.FailedPrecondition, "array %s of volume %s is not configured", arrayName, volumeID)
+	}
+
+	if err = a.DeleteVolume(name); err != nil {
+		return true, status.Errorf(codes.Internal, "Delete LUN %s on array %s failed: %v", name, arrayName, err)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,200 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/QQGoblin/extrootfs/pkg/array"
+	"github.com/QQGoblin/extrootfs/pkg/utils/iscsi"
+	"github.com/QQGoblin/extrootfs/pkg/utils/k8s"
+	"github.com/QQGoblin/extrootfs/pkg/utils/log"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// initiatorAnnotation 节点的 iscsi initiator 名称，ControllerPublishVolume 据此授权节点访问 LUN
+const initiatorAnnotation = "extrootfs.io/iscsi-initiator"
+
+// ControllerPublishVolume 允许节点的 initiator 访问阵列上的 LUN，其他卷不需要 attach
+func (cs *ControllerServer) ControllerPublishVolume(ctx context.Context, request *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+
+	if err := cs.validateControllerPublishVolumeRequest(request); err != nil {
+		return nil, err
+	}
+
+	// 只有阵列上的卷需要授权，qemu 卷只返回卷容量，手动创建的 iscsi 卷直接返回
+	volumeID := request.GetVolumeId()
+	if request.GetVolumeContext()[RootFSTypeKey] == RootfsTypeQemu {
+		return cs.publishQemuVolume(ctx, volumeID)
+	}
+	if request.GetVolumeContext()[arrayKey] == "" {
+		return &csi.ControllerPublishVolumeResponse{}, nil
+	}
+
+	name, arrayName, err := parseArrayVolumeID(volumeID)
+	if err != nil || arrayName != request.GetVolumeContext()[arrayKey] {
+		return nil, status.Errorf(codes.InvalidArgument, "volume %s is not on array %s", volumeID, request.GetVolumeContext()[arrayKey])
+	}
+
+	a, ok := cs.arrays[arrayName]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "array %s of volume %s is not configured", arrayName, volumeID)
+	}
+
+	initiator, err := cs.nodeInitiator(ctx, request.GetNodeId())
+	if apierrors.IsNotFound(err) {
+		return nil, status.Errorf(codes.NotFound, "node %s not found", request.GetNodeId())
+	} else if err != nil {
+		return nil, status.Errorf(codes.Internal, "Get initiator of node %s failed: %v", request.GetNodeId(), err)
+	}
+	if initiator == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "node %s has no %s annotation", request.GetNodeId(), initiatorAnnotation)
+	}
+
+	if acquired := cs.rootfsLock.TryAcquire(volumeID); !acquired {
+		return nil, status.Errorf(codes.Aborted, "an operation with the given Volume ID %s already exists", volumeID)
+	}
+	defer cs.rootfsLock.Release(volumeID)
+
+	// 非多节点访问模式下 LUN 只能授权给一个节点
+	mode := request.GetVolumeCapability().GetAccessMode().GetMode()
+	readOnly := request.GetReadonly() || isReadOnlyMode(mode)
+	err = a.Map(name, request.GetNodeId(), initiator, readOnly, !isMultiNode(mode))
+	if errors.Is(err, array.ErrMapped) {
+		return nil, status.Errorf(codes.FailedPrecondition, "Volume %s is attached to other nodes: %v", volumeID, err)
+	} else if err != nil {
+		return nil, status.Errorf(codes.Internal, "Map LUN %s to %s failed: %v", name, initiator, err)
+	}
+
+	log.DebugLog(ctx, "ControllerPublishVolume %s to node %s (%s) success", volumeID, request.GetNodeId(), initiator)
+
+	return &csi.ControllerPublishVolumeResponse{}, nil
+}
+
+// ControllerUnpublishVolume 撤销节点的 initiator 对阵列上 LUN 的访问，没有指定节点时撤销所有节点
+func (cs *ControllerServer) ControllerUnpublishVolume(ctx context.Context, request *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME); err != nil {
+		return nil, err
+	}
+	if request.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty volume ID in request")
+	}
+
+	volumeID := request.GetVolumeId()
+	if !isArrayVolumeID(volumeID) {
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+
+	name, arrayName, err := parseArrayVolumeID(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	a, ok := cs.arrays[arrayName]
+	if !ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "array %s of volume %s is not configured", arrayName, volumeID)
+	}
+
+	if acquired := cs.rootfsLock.TryAcquire(volumeID); !acquired {
+		return nil, status.Errorf(codes.Aborted, "an operation with the given Volume ID %s already exists", volumeID)
+	}
+	defer cs.rootfsLock.Release(volumeID)
+
+	// 按照 Map 时在阵列上记录的 initiator 撤销访问，节点或者节点注解已经删除时同样可以撤销
+	if err = a.Unmap(name, request.GetNodeId()); err != nil {
+		return nil, status.Errorf(codes.Internal, "Unmap LUN %s from node %q failed: %v", name, request.GetNodeId(), err)
+	}
+
+	log.DebugLog(ctx, "ControllerUnpublishVolume %s from node %q success", volumeID, request.GetNodeId())
+
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+// publishQemuVolume 在 publish context 中返回 PV 的容量。
+// qemu-nbd 不支持在线扩容，离线扩容后节点在下次 NodeStageVolume 连接设备前扩容 overlay。
+func (cs *ControllerServer) publishQemuVolume(ctx context.Context, volumeID string) (*csi.ControllerPublishVolumeResponse, error) {
+
+	pv, err := cs.findPV(ctx, volumeID)
+	if err != nil {
+		log.WarningLog(ctx, "ControllerPublishVolume %s: get capacity failed, skip: %v", volumeID, err)
+		return &csi.ControllerPublishVolumeResponse{}, nil
+	}
+
+	capacity, ok := pv.Spec.Capacity[v1.ResourceStorage]
+	if !ok {
+		return &csi.ControllerPublishVolumeResponse{}, nil
+	}
+
+	return &csi.ControllerPublishVolumeResponse{
+		PublishContext: map[string]string{qemuSizeKey: strconv.FormatInt(capacity.Value(), 10)},
+	}, nil
+}
+
+func (cs *ControllerServer) validateControllerPublishVolumeRequest(request *csi.ControllerPublishVolumeRequest) error {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME); err != nil {
+		return err
+	}
+	if request.GetVolumeId() == "" {
+		return status.Error(codes.InvalidArgument, "empty volume ID in request")
+	}
+	if request.GetNodeId() == "" {
+		return status.Error(codes.InvalidArgument, "empty node ID in request")
+	}
+	return validateVolumeCapability(request.GetVolumeCapability())
+}
+
+// nodeInitiator 从节点注解中读取节点的 iscsi initiator 名称
+func (cs *ControllerServer) nodeInitiator(ctx context.Context, nodeID string) (string, error) {
+
+	if cs.client == nil {
+		return "", status.Error(codes.FailedPrecondition, "kubernetes client is not initialized")
+	}
+
+	node, err := cs.client.CoreV1().Nodes().Get(ctx, nodeID, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	return node.GetAnnotations()[initiatorAnnotation], nil
+}
+
+// publishInitiator 将节点的 iscsi initiator 名称写入节点注解，节点没有配置 iscsi 时跳过
+func (r *Driver) publishInitiator() {
+
+	initiator, err := iscsi.InitiatorName()
+	if err != nil {
+		log.DebugLogMsg("Skip publishing iscsi initiator: %v", err)
+		return
+	}
+
+	client, err := k8s.NewClient()
+	if err != nil {
+		log.WarningLogMsg("Publish iscsi initiator %s failed: %v", initiator, err)
+		return
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{initiatorAnnotation: initiator},
+		},
+	})
+	if err != nil {
+		log.WarningLogMsg("Publish iscsi initiator %s failed: %v", initiator, err)
+		return
+	}
+
+	if _, err = client.CoreV1().Nodes().Patch(context.Background(), r.nodeid, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		log.WarningLogMsg("Publish iscsi initiator %s of node %s failed: %v", initiator, r.nodeid, err)
+		return
+	}
+
+	log.DefaultLog("Published iscsi initiator %s of node %s", initiator, r.nodeid)
+}
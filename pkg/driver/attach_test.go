@@ -0,0 +1,231 @@
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/QQGoblin/extrootfs/pkg/array"
+	csicommon "github.com/QQGoblin/extrootfs/pkg/csi-common"
+	"github.com/QQGoblin/extrootfs/pkg/utils/lock"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testDriverName = "driver.extrootfs.io"
+
+func testPV(name, volumeID, capacity string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity: v1.ResourceList{v1.ResourceStorage: resource.MustParse(capacity)},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: testDriverName, VolumeHandle: volumeID},
+			},
+		},
+	}
+}
+
+func TestPublishQemuVolumeCapacity(t *testing.T) {
+
+	cs := &ControllerServer{
+		driverName: testDriverName,
+		client:     fake.NewSimpleClientset(testPV("pv-1", "pvc-1", "20Gi")),
+	}
+
+	resp, err := cs.publishQemuVolume(context.Background(), "pvc-1")
+	if err != nil {
+		t.Fatalf("publishQemuVolume: %v", err)
+	}
+	if got := resp.GetPublishContext()[qemuSizeKey]; got != "21474836480" {
+		t.Errorf("publish context size = %q, want 21474836480", got)
+	}
+
+	// PV 不存在时不返回容量，不影响 attach
+	resp, err = cs.publishQemuVolume(context.Background(), "pvc-2")
+	if err != nil {
+		t.Fatalf("publishQemuVolume: %v", err)
+	}
+	if len(resp.GetPublishContext()) != 0 {
+		t.Errorf("publish context = %v, want empty", resp.GetPublishContext())
+	}
+}
+
+func TestStageConfigSize(t *testing.T) {
+
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:       "pvc-1",
+		VolumeContext:  map[string]string{RootFSTypeKey: RootfsTypeQemu, qemuImageKey: "base.qcow2", "csi.storage.k8s.io/pvc/name": "rootfs"},
+		PublishContext: map[string]string{qemuSizeKey: "21474836480"},
+	}
+
+	basePath := t.TempDir()
+	rootfs, err := NewQEMURootFS(req.VolumeId, basePath, t.TempDir(), stageConfig(req))
+	if err != nil {
+		t.Fatalf("NewQEMURootFS: %v", err)
+	}
+	if size := rootfs.(*QEMURootFS).Size; size != 21474836480 {
+		t.Errorf("Size = %d, want 21474836480", size)
+	}
+
+	// 节点上记录的目标大小更大时不会被 publish context 覆盖
+	rootfs.(*QEMURootFS).Size = 32 << 30
+	if err = rootfs.WriteConfig(); err != nil {
+		t.Fatal(err)
+	}
+	rootfs, err = NewQEMURootFS(req.VolumeId, basePath, t.TempDir(), stageConfig(req))
+	if err != nil {
+		t.Fatalf("NewQEMURootFS: %v", err)
+	}
+	if size := rootfs.(*QEMURootFS).Size; size != 32<<30 {
+		t.Errorf("Size = %d, want %d", size, int64(32<<30))
+	}
+}
+
+// fakeArray 在内存中记录 LUN 授权的节点
+type fakeArray struct {
+	// mapped LUN 名称到节点名称再到 initiator
+	mapped   map[string]map[string]string
+	readOnly map[string]bool
+}
+
+func newFakeArray() *fakeArray {
+	return &fakeArray{mapped: make(map[string]map[string]string), readOnly: make(map[string]bool)}
+}
+
+func (a *fakeArray) CreateVolume(name string, size int64, source string) (*array.Volume, error) {
+	return &array.Volume{Name: name, Size: size}, nil
+}
+
+func (a *fakeArray) DeleteVolume(name string) error {
+	delete(a.mapped, name)
+	return nil
+}
+
+func (a *fakeArray) Expand(name string, size int64) (int64, error) {
+	return size, nil
+}
+
+func (a *fakeArray) Map(name, node, initiator string, readOnly, exclusive bool) error {
+	if a.mapped[name] == nil {
+		a.mapped[name] = make(map[string]string)
+	}
+	for other := range a.mapped[name] {
+		if exclusive && other != node {
+			return errors.Wrapf(array.ErrMapped, "lun %s is mapped to %s", name, other)
+		}
+	}
+	a.mapped[name][node] = initiator
+	a.readOnly[name+"/"+node] = readOnly
+	return nil
+}
+
+func (a *fakeArray) Unmap(name, node string) error {
+	if node == "" {
+		delete(a.mapped, name)
+		return nil
+	}
+	delete(a.mapped[name], node)
+	return nil
+}
+
+func testNode(name, initiator string) *v1.Node {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if initiator != "" {
+		node.Annotations = map[string]string{initiatorAnnotation: initiator}
+	}
+	return node
+}
+
+func TestControllerPublishArrayVolume(t *testing.T) {
+
+	d := csicommon.NewCSIDriver(testDriverName, "test", "node-1")
+	d.AddControllerServiceCapabilities(controllerCapabilities(true))
+
+	a := newFakeArray()
+	cs := &ControllerServer{
+		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
+		driverName:              testDriverName,
+		rootfsLock:              lock.NewVolumeLocks(),
+		arrays:                  map[string]array.Array{"lio": a},
+		client: fake.NewSimpleClientset(
+			testNode("node-1", "iqn.2024-01.io.extrootfs:node-1"),
+			testNode("node-2", "iqn.2024-01.io.extrootfs:node-2"),
+			testNode("node-3", ""),
+		),
+	}
+
+	publish := func(volumeID, node string, mode csi.VolumeCapability_AccessMode_Mode, readOnly bool) error {
+		_, err := cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+			VolumeId: volumeID,
+			NodeId:   node,
+			Readonly: readOnly,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+			},
+			VolumeContext: map[string]string{RootFSTypeKey: RootfsTypeISCSI, arrayKey: "lio"},
+		})
+		return err
+	}
+
+	rwo := csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER
+	rox := csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+	volumeID := arrayVolumeID("pvc-1", "lio")
+
+	if err := publish(volumeID, "node-1", rwo, false); err != nil {
+		t.Fatalf("publish to node-1: %v", err)
+	}
+	// 重试同一个节点成功
+	if err := publish(volumeID, "node-1", rwo, false); err != nil {
+		t.Fatalf("publish to node-1 again: %v", err)
+	}
+	if got := a.mapped["pvc-1"]["node-1"]; got != "iqn.2024-01.io.extrootfs:node-1" {
+		t.Errorf("node-1 is mapped with initiator %q", got)
+	}
+
+	// 单节点访问模式下 LUN 不能授权给其他节点
+	if err := publish(volumeID, "node-2", rwo, false); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("publish to node-2: %v, want FailedPrecondition", err)
+	}
+
+	// 节点没有 initiator 注解，或者节点不存在
+	if err := publish(arrayVolumeID("pvc-2", "lio"), "node-3", rox, false); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("publish to node without initiator: %v, want FailedPrecondition", err)
+	}
+	if err := publish(arrayVolumeID("pvc-2", "lio"), "node-4", rox, false); status.Code(err) != codes.NotFound {
+		t.Errorf("publish to missing node: %v, want NotFound", err)
+	}
+
+	// 只读多节点访问模式授权给多个节点，并设置写保护
+	for _, node := range []string{"node-1", "node-2"} {
+		if err := publish(arrayVolumeID("pvc-2", "lio"), node, rox, false); err != nil {
+			t.Fatalf("publish pvc-2 to %s: %v", node, err)
+		}
+		if !a.readOnly["pvc-2/"+node] {
+			t.Errorf("pvc-2 is mapped to %s without write protect", node)
+		}
+	}
+
+	if err := publish(arrayVolumeID("pvc-1", "other"), "node-1", rwo, false); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("publish with mismatched array: %v, want InvalidArgument", err)
+	}
+
+	// 撤销后其他节点可以 attach
+	if _, err := cs.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeID, NodeId: "node-1"}); err != nil {
+		t.Fatalf("unpublish from node-1: %v", err)
+	}
+	if err := publish(volumeID, "node-2", rwo, false); err != nil {
+		t.Errorf("publish to node-2 after unpublish: %v", err)
+	}
+
+	// 不在阵列上的卷不需要撤销
+	if _, err := cs.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{VolumeId: "pvc-3", NodeId: "node-1"}); err != nil {
+		t.Errorf("unpublish non-array volume: %v", err)
+	}
+}
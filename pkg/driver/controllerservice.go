@@ -2,15 +2,30 @@ package driver
 
 import (
 	"context"
+	"github.com/QQGoblin/extrootfs/pkg/array"
 	csicommon "github.com/QQGoblin/extrootfs/pkg/csi-common"
+	"github.com/QQGoblin/extrootfs/pkg/utils/lock"
+	"github.com/QQGoblin/extrootfs/pkg/utils/log"
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/pkg/errors"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"os"
+	"strconv"
 )
 
 type ControllerServer struct {
 	*csicommon.DefaultControllerServer
-	driverName string
+	driverName     string
+	nodeID         string
+	basePath       string
+	rootfsLock     *lock.VolumeLocks
+	operationLocks *lock.OperationLock
+	arrays         map[string]array.Array
+	client         kubernetes.Interface
 }
 
 func (cs *ControllerServer) CreateVolume(ctx context.Context, request *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
@@ -18,28 +33,478 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, request *csi.Creat
 	if err := cs.validateCreateVolumeRequest(request); err != nil {
 		return nil, err
 	}
-	if request.VolumeContentSource != nil {
-		return nil, status.Error(codes.InvalidArgument, "not support for create volume from snapshot or clone")
+	parameters := make(map[string]string)
+	for k, v := range request.GetParameters() {
+		parameters[k] = v
+	}
+
+	if err := validateAccessModes(parameters[RootFSTypeKey], request.GetVolumeCapabilities()); err != nil {
+		return nil, err
+	}
+
+	// 抢占式挂载会踢掉其他节点的会话，不能用于多节点共享
+	if boolParameter(parameters, iscsiPreemptLunKey) {
+		for _, capability := range request.GetVolumeCapabilities() {
+			if isMultiNode(capability.GetAccessMode().GetMode()) {
+				return nil, status.Errorf(codes.InvalidArgument, "%s cannot be used with access mode %s", iscsiPreemptLunKey, capability.GetAccessMode().GetMode())
+			}
+		}
+	}
+
+	// 阵列上的 LUN 在这里创建，克隆由阵列完成
+	if parameters[arrayKey] != "" {
+		if request.GetVolumeContentSource().GetSnapshot() != nil {
+			return nil, status.Error(codes.InvalidArgument, "create array volume from snapshot is not supported")
+		}
+		if err := validateParameters(parameters); err != nil {
+			return nil, err
+		}
+		volume, err := cs.createArrayVolume(request, parameters)
+		if err != nil {
+			return nil, err
+		}
+		return &csi.CreateVolumeResponse{Volume: volume}, nil
+	}
+
+	// 克隆和快照恢复在节点第一次分配 rootfs 时完成，这里只记录数据来源
+	var sourceNode string
+	if source := request.GetVolumeContentSource(); source != nil {
+		if parameters[RootFSTypeKey] != RootfsTypeQemu {
+			return nil, status.Errorf(codes.InvalidArgument, "create volume from snapshot or clone is only supported for %s rootfs", RootfsTypeQemu)
+		}
+
+		switch {
+		case source.GetSnapshot() != nil:
+			snapshotID := source.GetSnapshot().GetSnapshotId()
+			_, snapshotNode, err := parseSnapshotID(snapshotID)
+			if err != nil {
+				return nil, status.Errorf(codes.NotFound, "source snapshot %s not found: %v", snapshotID, err)
+			}
+			sourceNode = snapshotNode
+			if err := cs.operationLocks.GetRestoreLock(snapshotID); err != nil {
+				return nil, status.Error(codes.Aborted, err.Error())
+			}
+			defer cs.operationLocks.ReleaseRestoreLock(snapshotID)
+			parameters[qemuSourceSnapshotKey] = snapshotID
+		case source.GetVolume() != nil:
+			volumeID := source.GetVolume().GetVolumeId()
+			volumeNode, err := cs.volumeNode(ctx, volumeID)
+			if err != nil {
+				return nil, err
+			}
+			sourceNode = volumeNode
+			if err := cs.operationLocks.GetCloneLock(volumeID); err != nil {
+				return nil, status.Error(codes.Aborted, err.Error())
+			}
+			defer cs.operationLocks.ReleaseCloneLock(volumeID)
+			parameters[qemuSourceVolumeKey] = volumeID
+		default:
+			return nil, status.Error(codes.InvalidArgument, "unknown volume content source")
+		}
+	}
+
+	// 参数错误在创建卷时返回，不要等到节点连接设备时才失败。
+	// 数据来源记录在参数中之后再校验，克隆和快照恢复不需要指定镜像
+	if err := validateParameters(parameters); err != nil {
+		return nil, err
+	}
+
+	topology, err := accessibleTopology(parameters[RootFSTypeKey], sourceNode, request.GetAccessibilityRequirements())
+	if err != nil {
+		return nil, err
 	}
-	parameters := request.GetParameters()
 
 	volume := &csi.Volume{
-		VolumeId:      request.Name,
-		CapacityBytes: request.GetCapacityRange().GetRequiredBytes(),
-		VolumeContext: parameters,
-		ContentSource: request.GetVolumeContentSource(),
+		VolumeId:           request.Name,
+		CapacityBytes:      request.GetCapacityRange().GetRequiredBytes(),
+		VolumeContext:      parameters,
+		ContentSource:      request.GetVolumeContentSource(),
+		AccessibleTopology: topology,
 	}
 
 	return &csi.CreateVolumeResponse{Volume: volume}, nil
 }
 
+// accessibleTopology 返回卷可以被访问的拓扑。
+// 节点本地的 rootfs（如 qemu overlay）只能在保存数据的节点上使用，网络存储（如 iscsi）不限制拓扑。
+func accessibleTopology(rootfsType, sourceNode string, requirement *csi.TopologyRequirement) ([]*csi.Topology, error) {
+
+	if !isNodeLocal(rootfsType) {
+		return nil, nil
+	}
+
+	// 快照保存在创建它的节点上，恢复出的 rootfs 只能位于同一个节点
+	node := sourceNode
+	if node == "" {
+		node = selectNode(requirement)
+	}
+	if node == "" {
+		// CO 没有提供拓扑信息时无法确定节点，不限制拓扑会导致卷在其他节点上被当作新卷创建
+		return nil, status.Errorf(codes.InvalidArgument, "accessibility requirements with %s are required for %s rootfs", topologyKeyNode, rootfsType)
+	}
+
+	if requisite := requirement.GetRequisite(); len(requisite) > 0 && !topologyContains(requisite, node) {
+		return nil, status.Errorf(codes.ResourceExhausted, "node %s is not in requisite topology", node)
+	}
+
+	return []*csi.Topology{{Segments: map[string]string{topologyKeyNode: node}}}, nil
+}
+
+// volumeNode 从来源卷的 PV 的节点亲和性中读取 overlay 所在的节点，克隆出的 rootfs 只能位于同一个节点
+func (cs *ControllerServer) volumeNode(ctx context.Context, volumeID string) (string, error) {
+
+	pv, err := cs.findPV(ctx, volumeID)
+	if err != nil {
+		return "", err
+	}
+
+	if pv.Spec.NodeAffinity != nil && pv.Spec.NodeAffinity.Required != nil {
+		for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+			for _, expr := range term.MatchExpressions {
+				if expr.Key == topologyKeyNode && len(expr.Values) == 1 {
+					return expr.Values[0], nil
+				}
+			}
+		}
+	}
+
+	return "", status.Errorf(codes.FailedPrecondition, "persistent volume %s of source volume %s has no %s affinity", pv.Name, volumeID, topologyKeyNode)
+}
+
+// findPV 查找卷对应的 PV
+func (cs *ControllerServer) findPV(ctx context.Context, volumeID string) (*v1.PersistentVolume, error) {
+
+	if cs.client == nil {
+		return nil, status.Error(codes.FailedPrecondition, "kubernetes client is not initialized")
+	}
+
+	pvs, err := cs.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "List persistent volumes failed: %v", err)
+	}
+
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == cs.driverName && pv.Spec.CSI.VolumeHandle == volumeID {
+			return pv, nil
+		}
+	}
+
+	return nil, status.Errorf(codes.NotFound, "persistent volume of volume %s not found", volumeID)
+}
+
+// isNodeLocal 判断 rootfs 的数据是否保存在节点本地
+func isNodeLocal(rootfsType string) bool {
+	return rootfsType == RootfsTypeQemu
+}
+
+// selectNode 优先选择 preferred 中的第一个节点，其次是 requisite 中的第一个节点
+func selectNode(requirement *csi.TopologyRequirement) string {
+	for _, topologies := range [][]*csi.Topology{requirement.GetPreferred(), requirement.GetRequisite()} {
+		for _, t := range topologies {
+			if node := t.GetSegments()[topologyKeyNode]; node != "" {
+				return node
+			}
+		}
+	}
+	return ""
+}
+
+func topologyContains(topologies []*csi.Topology, node string) bool {
+	for _, t := range topologies {
+		if t.GetSegments()[topologyKeyNode] == node {
+			return true
+		}
+	}
+	return false
+}
+
+func (cs *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, request *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+
+	if request.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty volume ID in request")
+	}
+	if len(request.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume capabilities cannot be empty")
+	}
+
+	// rootfs 类型记录在 volume context 中，controller 不保存卷的信息
+	rootfsType := request.GetVolumeContext()[RootFSTypeKey]
+	if rootfsType == "" {
+		rootfsType = request.GetParameters()[RootFSTypeKey]
+	}
+
+	if err := validateAccessModes(rootfsType, request.GetVolumeCapabilities()); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: status.Convert(err).Message()}, nil
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      request.GetVolumeContext(),
+			VolumeCapabilities: request.GetVolumeCapabilities(),
+			Parameters:         request.GetParameters(),
+		},
+	}, nil
+}
+
 func (cs *ControllerServer) DeleteVolume(ctx context.Context, request *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	if err := cs.validateDeleteVolumeRequest(request); err != nil {
 		return nil, err
 	}
+
+	volumeID := request.GetVolumeId()
+	if err := cs.operationLocks.GetDeleteLock(volumeID); err != nil {
+		return nil, status.Error(codes.Aborted, err.Error())
+	}
+	defer cs.operationLocks.ReleaseDeleteLock(volumeID)
+
+	if ok, err := cs.deleteArrayVolume(volumeID); ok {
+		if err != nil {
+			return nil, err
+		}
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	if err := cs.deleteLocalVolume(volumeID); err != nil {
+		return nil, err
+	}
+
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
+// deleteLocalVolume 删除保存在当前节点上的 qemu 卷，数据不在当前节点上时直接返回。
+// 节点上的快照记录标记源卷正在创建快照，此时拒绝删除
+func (cs *ControllerServer) deleteLocalVolume(volumeID string) error {
+
+	if acquired := cs.rootfsLock.TryAcquire(volumeID); !acquired {
+		return status.Errorf(codes.Aborted, lock.VolumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer cs.rootfsLock.Release(volumeID)
+
+	rootfs, err := LoadRootFS(volumeID, cs.basePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return status.Errorf(codes.Internal, "Load RootFS %s failed: %v", volumeID, err)
+	}
+
+	q, ok := rootfs.(*QEMURootFS)
+	if !ok {
+		return nil
+	}
+
+	if err = q.Cleanup(); err != nil {
+		if errors.Is(err, errSnapshotInProgress) || errors.Is(err, errDeviceConnected) {
+			return status.Errorf(codes.FailedPrecondition, "Delete RootFS %s failed: %v", volumeID, err)
+		}
+		return status.Errorf(codes.Internal, "Delete RootFS %s failed: %v", volumeID, err)
+	}
+
+	return nil
+}
+
+func (cs *ControllerServer) ControllerExpandVolume(ctx context.Context, request *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+
+	if err := cs.validateExpandVolumeRequest(request); err != nil {
+		return nil, err
+	}
+
+	volumeID := request.GetVolumeId()
+	if err := cs.operationLocks.GetExpandLock(volumeID); err != nil {
+		return nil, status.Error(codes.Aborted, err.Error())
+	}
+	defer cs.operationLocks.ReleaseExpandLock(volumeID)
+
+	// 阵列上的 LUN 由控制器扩容，节点只需要重新扫描设备
+	if ok, capacity, err := cs.expandArrayVolume(volumeID, request.GetCapacityRange().GetRequiredBytes()); ok {
+		if err != nil {
+			return nil, err
+		}
+		return &csi.ControllerExpandVolumeResponse{
+			CapacityBytes:         capacity,
+			NodeExpansionRequired: true,
+		}, nil
+	}
+
+	// rootfs 的数据保存在节点上，控制器只记录新的容量，由 NodeExpandVolume 完成实际的扩容
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         request.GetCapacityRange().GetRequiredBytes(),
+		NodeExpansionRequired: true,
+	}, nil
+}
+
+func (cs *ControllerServer) CreateSnapshot(ctx context.Context, request *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+
+	if err := cs.validateCreateSnapshotRequest(request); err != nil {
+		return nil, err
+	}
+
+	sourceID := request.GetSourceVolumeId()
+	id := snapshotID(request.GetName(), cs.nodeID)
+
+	if acquired := cs.rootfsLock.TryAcquire(sourceID); !acquired {
+		return nil, status.Errorf(codes.Aborted, lock.VolumeOperationAlreadyExistsFmt, sourceID)
+	}
+	defer cs.rootfsLock.Release(sourceID)
+
+	// 快照请求可能重试，已经完成的快照直接返回，未完成的快照是进程退出前留下的，重新创建
+	if snapshot, err := LoadSnapshot(id, cs.basePath); err == nil {
+		if snapshot.SourceVolumeID != sourceID {
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists for volume %s", id, snapshot.SourceVolumeID)
+		}
+		if !snapshot.InProgress {
+			return &csi.CreateSnapshotResponse{Snapshot: snapshot.ToCSI()}, nil
+		}
+	}
+
+	// 快照过程中不允许扩容源卷
+	if err := cs.operationLocks.GetSnapshotCreateLock(sourceID); err != nil {
+		return nil, status.Error(codes.Aborted, err.Error())
+	}
+	defer cs.operationLocks.ReleaseSnapshotCreateLock(sourceID)
+
+	rootfs, err := LoadRootFS(sourceID, cs.basePath)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "Load RootFS %s failed: %v", sourceID, err)
+	}
+
+	q, ok := rootfs.(*QEMURootFS)
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "snapshot is only supported for %s rootfs", RootfsTypeQemu)
+	}
+
+	if err := os.MkdirAll(snapshotDir(cs.basePath), 0755); err != nil {
+		return nil, status.Errorf(codes.Internal, "Create snapshot dir failed: %v", err)
+	}
+
+	// DeleteVolume 可能在其它进程中执行，通过节点上的快照记录标记源卷正在创建快照
+	snapshot := NewSnapshot(request.GetName(), cs.nodeID, cs.basePath, q)
+	snapshot.InProgress = true
+	if err := snapshot.WriteConfig(cs.basePath); err != nil {
+		return nil, status.Errorf(codes.Internal, "Write snapshot %s config failed: %v", id, err)
+	}
+
+	if err := q.Snapshot(snapshot.SnapshotPath); err != nil {
+		_ = snapshot.Delete(cs.basePath)
+		return nil, status.Errorf(codes.Internal, "Snapshot RootFS %s failed: %v", sourceID, err)
+	}
+
+	snapshot.InProgress = false
+	if err := snapshot.WriteConfig(cs.basePath); err != nil {
+		_ = snapshot.Delete(cs.basePath)
+		return nil, status.Errorf(codes.Internal, "Write snapshot %s config failed: %v", id, err)
+	}
+
+	log.DebugLog(ctx, "CreateSnapshot %s from RootFS %s success", id, sourceID)
+
+	return &csi.CreateSnapshotResponse{Snapshot: snapshot.ToCSI()}, nil
+}
+
+func (cs *ControllerServer) DeleteSnapshot(ctx context.Context, request *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		return nil, err
+	}
+
+	id := request.GetSnapshotId()
+	if id == "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshot ID cannot be empty")
+	}
+
+	_, nodeID, err := parseSnapshotID(id)
+	if err != nil {
+		// 无法识别的快照 ID 不可能由本驱动创建
+		log.WarningLog(ctx, "DeleteSnapshot ignore unknown snapshot %s: %v", id, err)
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+	if nodeID != cs.nodeID {
+		return nil, status.Errorf(codes.FailedPrecondition, "snapshot %s is stored on node %s", id, nodeID)
+	}
+
+	if acquired := cs.rootfsLock.TryAcquire(id); !acquired {
+		return nil, status.Errorf(codes.Aborted, lock.SnapshotOperationAlreadyExistsFmt, id)
+	}
+	defer cs.rootfsLock.Release(id)
+
+	// 快照正在用于恢复新的 rootfs 时不允许删除
+	if err := cs.operationLocks.GetDeleteLock(id); err != nil {
+		return nil, status.Error(codes.Aborted, err.Error())
+	}
+	defer cs.operationLocks.ReleaseDeleteLock(id)
+
+	snapshot, err := LoadSnapshot(id, cs.basePath)
+	if os.IsNotExist(err) {
+		return &csi.DeleteSnapshotResponse{}, nil
+	} else if err != nil {
+		return nil, status.Errorf(codes.Internal, "Load snapshot %s failed: %v", id, err)
+	}
+
+	if err := snapshot.Delete(cs.basePath); err != nil {
+		return nil, status.Errorf(codes.Internal, "Delete snapshot %s failed: %v", id, err)
+	}
+
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+func (cs *ControllerServer) ListSnapshots(ctx context.Context, request *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS); err != nil {
+		return nil, err
+	}
+
+	snapshots, err := ListSnapshots(cs.basePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "List snapshots failed: %v", err)
+	}
+
+	var entries []*csi.ListSnapshotsResponse_Entry
+	for _, snapshot := range snapshots {
+		if request.GetSnapshotId() != "" && request.GetSnapshotId() != snapshot.ID {
+			continue
+		}
+		if request.GetSourceVolumeId() != "" && request.GetSourceVolumeId() != snapshot.SourceVolumeID {
+			continue
+		}
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: snapshot.ToCSI()})
+	}
+
+	start := 0
+	if request.GetStartingToken() != "" {
+		if start, err = strconv.Atoi(request.GetStartingToken()); err != nil || start < 0 || start > len(entries) {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %s", request.GetStartingToken())
+		}
+	}
+
+	end := len(entries)
+	if maxEntries := int(request.GetMaxEntries()); maxEntries > 0 && start+maxEntries < end {
+		end = start + maxEntries
+	}
+
+	nextToken := ""
+	if end < len(entries) {
+		nextToken = strconv.Itoa(end)
+	}
+
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries[start:end],
+		NextToken: nextToken,
+	}, nil
+}
+
+func (cs *ControllerServer) validateCreateSnapshotRequest(request *csi.CreateSnapshotRequest) error {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		return err
+	}
+	if request.GetName() == "" {
+		return status.Error(codes.InvalidArgument, "snapshot name cannot be empty")
+	}
+	if request.GetSourceVolumeId() == "" {
+		return status.Error(codes.InvalidArgument, "source volume ID cannot be empty")
+	}
+	return nil
+}
+
 func (cs *ControllerServer) validateCreateVolumeRequest(request *csi.CreateVolumeRequest) error {
 	if request.Name == "" {
 		return status.Error(codes.InvalidArgument, "volume name cannot be empty")
@@ -57,3 +522,16 @@ func (cs *ControllerServer) validateDeleteVolumeRequest(request *csi.DeleteVolum
 	}
 	return nil
 }
+
+func (cs *ControllerServer) validateExpandVolumeRequest(request *csi.ControllerExpandVolumeRequest) error {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_EXPAND_VOLUME); err != nil {
+		return err
+	}
+	if request.GetVolumeId() == "" {
+		return status.Error(codes.InvalidArgument, "empty volume ID in request")
+	}
+	if request.GetCapacityRange() == nil {
+		return status.Error(codes.InvalidArgument, "capacity range cannot be empty")
+	}
+	return nil
+}
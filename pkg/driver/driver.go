@@ -1,11 +1,17 @@
 package driver
 
 import (
+	"github.com/QQGoblin/extrootfs/pkg/array"
 	csicommon "github.com/QQGoblin/extrootfs/pkg/csi-common"
+	"github.com/QQGoblin/extrootfs/pkg/image"
+	"github.com/QQGoblin/extrootfs/pkg/utils/k8s"
 	"github.com/QQGoblin/extrootfs/pkg/utils/lock"
 	"github.com/QQGoblin/extrootfs/pkg/utils/log"
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/client-go/kubernetes"
 	"os"
+	"strings"
+	"time"
 )
 
 const (
@@ -22,11 +28,19 @@ type Driver struct {
 	endpoint               string
 	basePath               string
 	outputBase             string
+	imageSource            string
+	imagePublicKey         string
+	imageGCPolicy          image.GCPolicy
+	images                 *image.Manager
+	prepullConfigMap       string
+	prepuller              *image.Prepuller
+	forceDetachGracePeriod time.Duration
+	arrayConfig            string
 	ctrlCapCreateAndDelete bool
 }
 
 // NewDriver returns new ceph driver.
-func NewDriver(name, nodeid, endpoint, basePath, outputBase string, ctrlCapCreateAndDelete bool) *Driver {
+func NewDriver(name, nodeid, endpoint, basePath, outputBase, imageSource, imagePublicKey string, imageGCPolicy image.GCPolicy, prepullConfigMap string, forceDetachGracePeriod time.Duration, arrayConfig string, ctrlCapCreateAndDelete bool) *Driver {
 	return &Driver{
 		csiDriver:              csicommon.NewCSIDriver(name, nodeid, endpoint),
 		servers:                &csicommon.Servers{},
@@ -35,38 +49,97 @@ func NewDriver(name, nodeid, endpoint, basePath, outputBase string, ctrlCapCreat
 		endpoint:               endpoint,
 		basePath:               basePath,
 		outputBase:             outputBase,
+		imageSource:            imageSource,
+		imagePublicKey:         imagePublicKey,
+		imageGCPolicy:          imageGCPolicy,
+		prepullConfigMap:       prepullConfigMap,
+		forceDetachGracePeriod: forceDetachGracePeriod,
+		arrayConfig:            arrayConfig,
 		ctrlCapCreateAndDelete: ctrlCapCreateAndDelete,
 	}
 }
 
-func (r *Driver) NewServers() {
+// nodeCapabilities 节点服务的能力
+var nodeCapabilities = []csi.NodeServiceCapability_RPC_Type{
+	csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+	csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+	csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+	csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+	csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+}
+
+// controllerCapabilities 控制器服务的能力，createAndDelete 为 false 时由外部创建卷
+func controllerCapabilities(createAndDelete bool) []csi.ControllerServiceCapability_RPC_Type {
 
-	var ctrlCap []csi.ControllerServiceCapability_RPC_Type
-	if r.ctrlCapCreateAndDelete {
-		ctrlCap = append(ctrlCap, csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME)
+	var caps []csi.ControllerServiceCapability_RPC_Type
+	if createAndDelete {
+		caps = append(caps, csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME)
 	}
 
-	r.csiDriver.AddControllerServiceCapabilities(ctrlCap)
+	return append(caps,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+	)
+}
+
+func (r *Driver) NewServers() {
+
+	r.csiDriver.AddControllerServiceCapabilities(controllerCapabilities(r.ctrlCapCreateAndDelete))
+	r.csiDriver.AddNodeServiceCapabilities(nodeCapabilities)
 
-	r.csiDriver.AddNodeServiceCapabilities([]csi.NodeServiceCapability_RPC_Type{})
+	r.csiDriver.AddVolumeCapabilityAccessModes(supportedAccessModes())
 
 	r.servers.IS = csicommon.NewDefaultIdentityServer(r.csiDriver)
 
+	// 控制器和节点服务运行在同一个进程中，共享锁避免快照与连接、扩容等操作并发
+	rootfsLock := lock.NewVolumeLocks()
+	operationLocks := lock.NewOperationLock()
+
+	arrays := r.loadArrays()
+
 	r.servers.CS = &ControllerServer{
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(r.csiDriver),
 		driverName:              r.name,
+		nodeID:                  r.nodeid,
+		basePath:                r.basePath,
+		rootfsLock:              rootfsLock,
+		operationLocks:          operationLocks,
+		arrays:                  arrays,
+		client:                  r.controllerClient(arrays),
 	}
 
 	if err := os.MkdirAll(r.outputBase, 0755); err != nil {
 		log.FatalLogMsg("Failed to initialize output.")
 	}
 
+	var source image.Source
+	if r.imageSource != "" {
+		var err error
+		if source, err = image.NewSource(r.imageSource); err != nil {
+			log.FatalLogMsg("Failed to initialize image source: %v", err)
+		}
+	}
+
+	verifier, err := image.NewVerifier(r.imagePublicKey)
+	if err != nil {
+		log.FatalLogMsg("Failed to initialize image verifier: %v", err)
+	}
+
+	r.images = image.NewManager(NewImageStore(r.basePath), source, verifier)
+
 	r.servers.NS = &NodeServer{
-		DefaultNodeServer: csicommon.NewDefaultNodeServer(r.csiDriver, map[string]string{topologyKeyNode: r.nodeid}),
-		driverName:        r.name,
-		basePath:          r.basePath,
-		outputBase:        r.outputBase,
-		rootfsLock:        lock.NewVolumeLocks(),
+		DefaultNodeServer:      csicommon.NewDefaultNodeServer(r.csiDriver, map[string]string{topologyKeyNode: r.nodeid}),
+		driverName:             r.name,
+		basePath:               r.basePath,
+		outputBase:             r.outputBase,
+		rootfsLock:             rootfsLock,
+		operationLocks:         operationLocks,
+		images:                 r.images,
+		forceDetachGracePeriod: r.forceDetachGracePeriod,
+		inUseSince:             make(map[string]time.Time),
 	}
 
 }
@@ -78,7 +151,74 @@ func (r *Driver) Run() {
 		log.FatalLogMsg("Failed to initialize CSI Driver.")
 	}
 	r.NewServers()
+
+	if r.prepullConfigMap != "" {
+		r.startPrepuller()
+	}
+
+	r.publishInitiator()
+
+	go r.images.RunGC(r.imageGCPolicy, func() (map[string]bool, error) {
+		refs, err := ImageReferences(r.basePath)
+		if err != nil {
+			return nil, err
+		}
+		// 预拉取的镜像即使没有被使用也需要保留
+		if r.prepuller != nil {
+			for name := range r.prepuller.Wanted() {
+				refs[r.images.Store().Path(name)] = true
+			}
+		}
+		return refs, nil
+	}, nil)
+
 	s := csicommon.NewNonBlockingGRPCServer()
 	s.Start(r.endpoint, *r.servers)
 	s.Wait()
 }
+
+func (r *Driver) startPrepuller() {
+
+	namespace, name, ok := strings.Cut(r.prepullConfigMap, "/")
+	if !ok || namespace == "" || name == "" {
+		log.FatalLogMsg("Invalid prepull configmap %s, expect <namespace>/<name>", r.prepullConfigMap)
+	}
+
+	client, err := k8s.NewClient()
+	if err != nil {
+		log.FatalLogMsg("Failed to initialize kubernetes client: %v", err)
+	}
+
+	r.prepuller = image.NewPrepuller(client, r.images, r.nodeid, namespace, name)
+	go r.prepuller.Run(make(chan struct{}))
+}
+
+// loadArrays 读取用于创建 iscsi LUN 的存储阵列
+func (r *Driver) loadArrays() map[string]array.Array {
+
+	if r.arrayConfig == "" {
+		return make(map[string]array.Array)
+	}
+
+	arrays, err := array.Load(r.arrayConfig)
+	if err != nil {
+		log.FatalLogMsg("Failed to load array config: %v", err)
+	}
+
+	return arrays
+}
+
+// controllerClient 创建控制器使用的客户端：克隆时读取来源 PV 的节点，ControllerPublishVolume 读取 PV 容量和节点 initiator。
+// 没有配置阵列时客户端初始化失败不影响其他功能，克隆会返回错误，qemu 卷扩容在节点记录目标大小后才生效。
+func (r *Driver) controllerClient(arrays map[string]array.Array) kubernetes.Interface {
+
+	client, err := k8s.NewClient()
+	if err != nil && len(arrays) > 0 {
+		log.FatalLogMsg("Failed to initialize kubernetes client: %v", err)
+	} else if err != nil {
+		log.WarningLogMsg("Failed to initialize kubernetes client, clone and qemu volume capacity are disabled: %v", err)
+		return nil
+	}
+
+	return client
+}
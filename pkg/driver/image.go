@@ -0,0 +1,149 @@
+package driver
+
+import (
+	"github.com/QQGoblin/extrootfs/pkg/image"
+	"github.com/QQGoblin/extrootfs/pkg/utils"
+	"github.com/QQGoblin/extrootfs/pkg/utils/log"
+	"github.com/QQGoblin/extrootfs/pkg/utils/qemu"
+	"github.com/pkg/errors"
+	"os"
+	"path"
+	"time"
+)
+
+// NewImageStore 返回节点上 qemu 基础镜像的存储目录
+func NewImageStore(basePath string) *image.Store {
+	return image.NewStore(path.Join(basePath, RootfsTypeQemu, DefaultImagesDir))
+}
+
+// CommitRootFS 将 rootfs 的 overlay 合并为新的基础镜像，新镜像可以直接通过 extrootfs.io/qemu/image 引用
+func CommitRootFS(rootfsID, basePath, name string) (*image.Manifest, error) {
+
+	rootfs, err := LoadRootFS(rootfsID, basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	q, ok := rootfs.(*QEMURootFS)
+	if !ok {
+		return nil, errors.Errorf("commit is only supported for %s rootfs", RootfsTypeQemu)
+	}
+
+	return q.Commit(NewImageStore(basePath), name)
+}
+
+// Commit 合并 overlay 及其基础镜像，生成独立的基础镜像并注册到镜像目录。
+// 设备连接时只刷新缓存后复制，得到的是崩溃一致性的镜像。
+func (q *QEMURootFS) Commit(store *image.Store, name string) (*image.Manifest, error) {
+
+	if err := image.ValidateName(name); err != nil {
+		return nil, err
+	}
+
+	if store.Exists(name) {
+		return nil, errors.Errorf("image %s already exists", name)
+	}
+
+	if q.BaseInfo == nil {
+		return nil, errors.Errorf("rootfs %s is not allocated", q.ID)
+	}
+
+	if q.Device != "" {
+		if err := utils.FlushBlockDevice(q.Device); err != nil {
+			return nil, errors.Wrap(err, "commit")
+		}
+	}
+
+	temp := store.TempPath(name)
+	defer os.Remove(temp)
+
+	log.DefaultLog("Commit %s to image %s", q.RootFSPath, name)
+	if err := qemu.ConvertImage(temp, q.RootFSPath, q.BaseInfo.Format); err != nil {
+		return nil, errors.Wrap(err, "commit")
+	}
+
+	info, err := qemu.ImageInfo(temp)
+	if err != nil {
+		return nil, errors.Wrap(err, "commit")
+	}
+
+	digest, err := image.FileDigest(temp)
+	if err != nil {
+		return nil, errors.Wrap(err, "commit")
+	}
+
+	manifest := &image.Manifest{
+		Name:        name,
+		Digest:      digest,
+		Format:      info.Format,
+		VirtualSize: info.VirtualSize,
+		Source:      "rootfs:" + q.ID,
+		CreatedAt:   time.Now(),
+	}
+
+	if err = store.Register(temp, manifest); err != nil {
+		return nil, errors.Wrap(err, "commit")
+	}
+
+	return manifest, nil
+}
+
+// ImageReferences 返回节点上所有 overlay 和快照引用的基础镜像路径。
+// 无法确定引用关系时返回错误，调用方不应在这种情况下回收镜像。
+func ImageReferences(basePath string) (map[string]bool, error) {
+
+	refs := make(map[string]bool)
+
+	entries, err := os.ReadDir(basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == RootfsTypeQemu {
+			continue
+		}
+		dataPath := path.Join(basePath, entry.Name())
+
+		rootfs, err := LoadQEMURootFS(dataPath)
+		if err == nil {
+			refs[rootfs.ImagePath] = true
+			if rootfs.BaseInfo != nil {
+				refs[rootfs.BaseInfo.Filename] = true
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "load rootfs %s", dataPath)
+		}
+
+		// 配置文件可能尚未写入，直接读取 overlay 的 backing file
+		overlay := path.Join(dataPath, DefaultRootFSFile)
+		if _, err = os.Stat(overlay); os.IsNotExist(err) {
+			continue
+		}
+		if rootfs == nil && !isQEMURootFS(dataPath) {
+			continue
+		}
+		backing, err := qemu.BackingFile(overlay)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read backing file of %s", overlay)
+		}
+		if backing != "" {
+			refs[backing] = true
+		}
+	}
+
+	snapshots, err := ListSnapshots(basePath)
+	if err != nil {
+		return nil, err
+	}
+	for _, snapshot := range snapshots {
+		refs[snapshot.ImagePath] = true
+	}
+
+	return refs, nil
+}
+
+func isQEMURootFS(dataPath string) bool {
+	b, err := os.ReadFile(path.Join(dataPath, DefaultTypeFile))
+	return err == nil && string(b) == RootfsTypeQemu
+}
@@ -2,6 +2,7 @@ package driver
 
 import (
 	"encoding/json"
+	"github.com/QQGoblin/extrootfs/pkg/utils"
 	"github.com/QQGoblin/extrootfs/pkg/utils/iscsi"
 	"github.com/QQGoblin/extrootfs/pkg/utils/log"
 	"github.com/pkg/errors"
@@ -11,7 +12,6 @@ import (
 	"path"
 	"path/filepath"
 	"strconv"
-	"strings"
 )
 
 const (
@@ -56,7 +56,7 @@ func NewISCSIRootFS(rootfsID, basePath, outputBase string, config map[string]str
 		Lun:        lun,
 		Username:   config[iscsiUserKey],
 		Password:   config[iscsiPasswordKey],
-		PreemptLun: strings.ToLower(config[iscsiPreemptLunKey]) == "true",
+		PreemptLun: boolParameter(config, iscsiPreemptLunKey),
 	}
 
 	return rootfs, nil
@@ -87,14 +87,29 @@ func (irs *ISCSIRootFS) Connect() error {
 		}
 	}
 
+	if err := irs.probeRootDevice(iscsiDisk.DevicePath); err != nil {
+		_ = iscsiDisk.DetachDisk()
+		irs.Device = ""
+		irs.Disk = ""
+		return err
+	}
+
+	if irs.ReadOnly {
+		if err := irs.setReadOnly(); err != nil {
+			_ = iscsiDisk.DetachDisk()
+			irs.Device = ""
+			irs.Disk = ""
+			return err
+		}
+	}
 	irs.ISCSIDisk = iscsiDisk
-	irs.Device = iscsiDisk.DevicePath
 
 	return nil
 }
 
 func (irs *ISCSIRootFS) Disconnect() error {
 	irs.Device = ""
+	irs.Disk = ""
 	if irs.ISCSIDisk == nil {
 		return nil
 	}
@@ -106,6 +121,78 @@ func (irs *ISCSIRootFS) Disconnect() error {
 	return nil
 }
 
+func (irs *ISCSIRootFS) Healthy() error {
+
+	if irs.ISCSIDisk == nil {
+		return errors.Errorf("rootfs %s is not connected", irs.ID)
+	}
+
+	if _, err := os.Stat(irs.ISCSIDisk.DevicePath); err != nil {
+		return errors.Wrap(err, "check device")
+	}
+
+	return irs.ISCSIDisk.CheckSessionState()
+}
+
+func (irs *ISCSIRootFS) Holders() ([]string, error) {
+	if irs.Disk == "" {
+		return nil, nil
+	}
+	return utils.DeviceHolders(irs.Disk, irs.ownMounts())
+}
+
+func (irs *ISCSIRootFS) Usage() (int64, int64, error) {
+
+	if irs.Disk == "" {
+		return 0, 0, errors.Errorf("rootfs %s is not connected", irs.ID)
+	}
+
+	capacity, err := utils.GetBlockDeviceSize(irs.Disk)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// LUN 在存储端的实际占用无法获取
+	return capacity, -1, nil
+}
+
+func (irs *ISCSIRootFS) Matches(config map[string]string) error {
+
+	if config[RootFSTypeKey] != RootfsTypeISCSI {
+		return errors.Errorf("rootfs %s is %s, not %s", irs.ID, RootfsTypeISCSI, config[RootFSTypeKey])
+	}
+
+	if irs.Target != config[iscsiTargetKey] || len(irs.Portals) == 0 || irs.Portals[0] != config[iscsiPortalKey] || strconv.Itoa(irs.Lun) != config[iscsiLunKey] {
+		return errors.Errorf("rootfs %s is connected to %s lun %d on %v", irs.ID, irs.Target, irs.Lun, irs.Portals)
+	}
+
+	return nil
+}
+
+func (irs *ISCSIRootFS) Expand(size int64) (int64, error) {
+
+	if irs.ISCSIDisk == nil {
+		return 0, errors.New("iscsi disk is not connected")
+	}
+
+	// LUN 需要已经在存储端完成扩容，这里只负责刷新本地设备大小
+	if err := irs.ISCSIDisk.Rescan(); err != nil {
+		return 0, errors.Wrap(err, "expand")
+	}
+
+	// Device 可能是根分区，容量以整个磁盘为准
+	deviceSize, err := utils.GetBlockDeviceSize(irs.ISCSIDisk.DevicePath)
+	if err != nil {
+		return 0, errors.Wrap(err, "expand")
+	}
+
+	if deviceSize < size {
+		return 0, errors.Errorf("device %s size %d is smaller than requested %d", irs.ISCSIDisk.DevicePath, deviceSize, size)
+	}
+
+	return deviceSize, nil
+}
+
 func (irs *ISCSIRootFS) Cleanup() error {
 	//TODO implement me
 	panic("implement me")
@@ -0,0 +1,133 @@
+package driver
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/QQGoblin/extrootfs/pkg/utils/log"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/pkg/errors"
+	mount "k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
+)
+
+const (
+	// mountTargetKey 为 true 时，除了写入输出文件，还将 rootfs 挂载到 CSI 的 target path
+	mountTargetKey = "extrootfs.io/mount-target"
+
+	defaultMountFsType = "ext4"
+)
+
+func isMountTarget(volContext map[string]string) bool {
+	return boolParameter(volContext, mountTargetKey)
+}
+
+// mountStaging 将 rootfs 设备挂载到 staging path，设备上没有文件系统时先格式化
+func (ns *NodeServer) mountStaging(rs *BaseRootFS, stagingPath string, capability *csi.VolumeCapability) error {
+
+	if rs.Device == "" {
+		return errors.Errorf("rootfs %s is not connected", rs.ID)
+	}
+
+	if err := os.MkdirAll(stagingPath, 0750); err != nil {
+		return errors.Wrap(err, "mount staging")
+	}
+
+	notMnt, err := ns.Mounter.IsLikelyNotMountPoint(stagingPath)
+	if err != nil {
+		return errors.Wrap(err, "mount staging")
+	}
+	if !notMnt {
+		log.DefaultLog("Staging path %s of rootfs %s is already mounted", stagingPath, rs.ID)
+		rs.MountPath = stagingPath
+		return nil
+	}
+
+	fsType := capability.GetMount().GetFsType()
+	if fsType == "" {
+		fsType = rs.FileSystemType
+	}
+	if fsType == "" {
+		fsType = defaultMountFsType
+	}
+
+	options := capability.GetMount().GetMountFlags()
+	if rs.ReadOnly {
+		options = append(options, "ro")
+	}
+
+	log.DefaultLog("Mount %s to %s, fs type: %s, options: %v", rs.Device, stagingPath, fsType, options)
+	mounter := mount.NewSafeFormatAndMount(ns.Mounter, utilexec.New())
+	if err = mounter.FormatAndMount(rs.Device, stagingPath, fsType, options); err != nil {
+		return errors.Wrap(err, "mount staging")
+	}
+
+	rs.MountPath = stagingPath
+	if rs.FileSystemType == "" {
+		rs.FileSystemType = fsType
+	}
+
+	return nil
+}
+
+// unmountStaging 卸载 rootfs 挂载的 staging path，必须在断开设备前执行
+func (ns *NodeServer) unmountStaging(rs *BaseRootFS) error {
+
+	if rs.MountPath == "" {
+		return nil
+	}
+
+	log.DefaultLog("Unmount %s of rootfs %s", rs.MountPath, rs.ID)
+	if err := mount.CleanupMountPoint(rs.MountPath, ns.Mounter, true); err != nil {
+		return errors.Wrap(err, "unmount staging")
+	}
+
+	rs.MountPath = ""
+	return nil
+}
+
+// bindTarget 将 source bind mount 到 Pod 的 target path，Block 模式下 source 为设备文件，target path 为普通文件
+func (ns *NodeServer) bindTarget(source, targetPath string, block, readonly bool) error {
+
+	if block {
+		if err := os.MkdirAll(filepath.Dir(targetPath), 0750); err != nil {
+			return errors.Wrap(err, "bind target")
+		}
+		f, err := os.OpenFile(targetPath, os.O_CREATE, 0640)
+		if err != nil {
+			return errors.Wrap(err, "bind target")
+		}
+		f.Close()
+	} else if err := os.MkdirAll(targetPath, 0750); err != nil {
+		return errors.Wrap(err, "bind target")
+	}
+
+	notMnt, err := ns.Mounter.IsLikelyNotMountPoint(targetPath)
+	if err != nil {
+		return errors.Wrap(err, "bind target")
+	}
+	if !notMnt {
+		log.DefaultLog("Target %s is already mounted", targetPath)
+		return nil
+	}
+
+	options := []string{"bind"}
+	if readonly {
+		options = append(options, "ro")
+	}
+
+	log.DefaultLog("Bind %s to %s, options: %v", source, targetPath, options)
+	if err = ns.Mounter.Mount(source, targetPath, "", options); err != nil {
+		return errors.Wrap(err, "bind target")
+	}
+
+	return nil
+}
+
+// unbindTarget 卸载并删除 Pod 的 target path，target path 未挂载或者不存在时直接返回
+func (ns *NodeServer) unbindTarget(targetPath string) error {
+	if err := mount.CleanupMountPoint(targetPath, ns.Mounter, true); err != nil {
+		return errors.Wrap(err, "unbind target")
+	}
+	return nil
+}
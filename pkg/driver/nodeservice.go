@@ -2,25 +2,40 @@ package driver
 
 import (
 	"context"
+	"fmt"
 	csicommon "github.com/QQGoblin/extrootfs/pkg/csi-common"
+	"github.com/QQGoblin/extrootfs/pkg/image"
 	"github.com/QQGoblin/extrootfs/pkg/utils/lock"
 	"github.com/QQGoblin/extrootfs/pkg/utils/log"
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
 type NodeServer struct {
 	*csicommon.DefaultNodeServer
-	driverName string
-	basePath   string
-	outputBase string
-	rootfsLock *lock.VolumeLocks
+	driverName     string
+	basePath       string
+	outputBase     string
+	rootfsLock     *lock.VolumeLocks
+	operationLocks *lock.OperationLock
+	images         *image.Manager
+	// 设备仍被使用时拒绝断开，超过该时间后强制断开，为 0 时不强制断开
+	forceDetachGracePeriod time.Duration
+	inUseMutex             sync.Mutex
+	inUseSince             map[string]time.Time
 }
 
-func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+// NodeStageVolume 在节点上连接 rootfs 设备，同一个卷在一个节点上只连接一次
+func (ns *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 
-	if err := ns.validateNodePublishVolumeRequest(req); err != nil {
+	if err := ns.validateNodeStageVolumeRequest(req); err != nil {
 		return nil, err
 	}
 
@@ -32,7 +47,48 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	}
 	defer ns.rootfsLock.Release(rootfsID)
 
-	rootfs, err := NewRootFS(rootfsID, req.VolumeContext[RootFSTypeKey], ns.basePath, ns.outputBase, req.VolumeContext)
+	// 克隆和恢复时，避免来源 rootfs 被扩容或者来源快照被删除
+	if source := req.VolumeContext[qemuSourceVolumeKey]; source != "" {
+		if err := ns.operationLocks.GetCloneLock(source); err != nil {
+			return nil, status.Error(codes.Aborted, err.Error())
+		}
+		defer ns.operationLocks.ReleaseCloneLock(source)
+	}
+	if source := req.VolumeContext[qemuSourceSnapshotKey]; source != "" {
+		if err := ns.operationLocks.GetRestoreLock(source); err != nil {
+			return nil, status.Error(codes.Aborted, err.Error())
+		}
+		defer ns.operationLocks.ReleaseRestoreLock(source)
+	}
+
+	readOnly := isReadOnlyMode(req.GetVolumeCapability().GetAccessMode().GetMode())
+
+	// kubelet 会重试 NodeStageVolume，设备已经连接并且健康时直接返回，避免重复连接
+	var publishes map[string]bool
+	if staged, err := LoadRootFS(rootfsID, ns.basePath); err == nil && staged.Base().Device != "" {
+		if err = staged.Matches(req.VolumeContext); err != nil {
+			return nil, status.Errorf(codes.AlreadyExists, "RootFS %s is staged with different parameters: %v", rootfsID, err)
+		}
+		if staged.Base().ReadOnly != readOnly {
+			return nil, status.Errorf(codes.AlreadyExists, "RootFS %s is staged with read-only %t", rootfsID, staged.Base().ReadOnly)
+		}
+		if err = staged.Healthy(); err == nil {
+			return ns.restage(ctx, staged, req)
+		}
+		log.WarningLog(ctx, "RootFS %s is staged but unhealthy, reconnect: %v", rootfsID, err)
+		// 重新连接不影响已经 publish 的 target path
+		publishes = staged.Base().Publishes
+		if err = ns.unmountStaging(staged.Base()); err != nil {
+			return nil, status.Errorf(codes.Internal, "Unmount RootFS %s failed: %v", rootfsID, err)
+		}
+		staged.Disconnect()
+	}
+
+	if err := ns.ensureImage(ctx, req.VolumeContext); err != nil {
+		return nil, err
+	}
+
+	rootfs, err := NewRootFS(rootfsID, req.VolumeContext[RootFSTypeKey], ns.basePath, ns.outputBase, stageConfig(req))
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "New RootFS %s failed: %v", rootfsID, err)
 	}
@@ -41,29 +97,208 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		return nil, status.Errorf(codes.Internal, "Allocate RootFS %s failed: %v", rootfsID, err)
 	}
 
-	//TODO: 判断 rootfs 是否在使用？
-
+	rootfs.Base().ReadOnly = readOnly
+	rootfs.Base().Publishes = publishes
 	if err := rootfs.Connect(); err != nil {
 		rootfs.Disconnect()
 		return nil, status.Errorf(codes.Internal, "Connect RootFS %s failed: %v", rootfsID, err)
 	}
 
+	// 文件系统挂载到 staging path，各个 Pod 的 target path 再从 staging path bind mount
+	if req.GetVolumeCapability().GetMount() != nil && isMountTarget(req.VolumeContext) {
+		if err := ns.mountStaging(rootfs.Base(), req.GetStagingTargetPath(), req.GetVolumeCapability()); err != nil {
+			rootfs.Disconnect()
+			return nil, status.Errorf(codes.Internal, "Mount RootFS %s failed: %v", rootfsID, err)
+		}
+	}
+
 	if err := rootfs.WriteConfig(); err != nil {
+		_ = ns.unmountStaging(rootfs.Base())
 		rootfs.Disconnect()
 		return nil, status.Errorf(codes.Internal, "Write RootFS %s config failed: %v", rootfsID, err)
 	}
 
-	log.DebugLog(ctx, "NodePublishVolume RootFS success: %v", rootfs)
+	log.DebugLog(ctx, "NodeStageVolume RootFS success: %v", rootfs)
+
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// stageConfig 返回创建 rootfs 使用的参数，包括 ControllerPublishVolume 返回的卷容量
+func stageConfig(req *csi.NodeStageVolumeRequest) map[string]string {
+	config := make(map[string]string, len(req.GetVolumeContext())+1)
+	for k, v := range req.GetVolumeContext() {
+		config[k] = v
+	}
+	if size := req.GetPublishContext()[qemuSizeKey]; size != "" {
+		config[qemuSizeKey] = size
+	}
+	return config
+}
+
+// restage 处理已经连接的 rootfs，只补充可能缺失的 staging path 挂载
+func (ns *NodeServer) restage(ctx context.Context, rootfs RootFS, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+
+	// 旧版本的配置文件中没有记录磁盘，当时输出的设备即为整个磁盘
+	if base := rootfs.Base(); base.Disk == "" {
+		base.Disk = base.Device
+	}
+
+	if req.GetVolumeCapability().GetMount() != nil && isMountTarget(req.VolumeContext) {
+		if err := ns.mountStaging(rootfs.Base(), req.GetStagingTargetPath(), req.GetVolumeCapability()); err != nil {
+			return nil, status.Errorf(codes.Internal, "Mount RootFS %s failed: %v", req.VolumeId, err)
+		}
+	}
+
+	if err := rootfs.WriteConfig(); err != nil {
+		return nil, status.Errorf(codes.Internal, "Write RootFS %s config failed: %v", req.VolumeId, err)
+	}
+
+	log.DebugLog(ctx, "RootFS %s is already staged on %s", req.VolumeId, rootfs.Base().Disk)
+
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// NodeUnstageVolume 断开 rootfs 设备
+func (ns *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+
+	if err := ns.validateNodeUnstageVolumeRequest(req); err != nil {
+		return nil, err
+	}
+
+	rootfsID := req.VolumeId
+
+	if acquired := ns.rootfsLock.TryAcquire(rootfsID); !acquired {
+		return nil, status.Errorf(codes.Aborted, "an operation with the given Volume ID %s already exists", rootfsID)
+	}
+	defer ns.rootfsLock.Release(rootfsID)
+
+	// NodeUnstageVolume 需要幂等，卷没有 stage 过或者已经被删除时直接返回成功
+	rootfs, err := LoadRootFS(rootfsID, ns.basePath)
+	if errors.Is(err, os.ErrNotExist) {
+		log.DebugLog(ctx, "NodeUnstageVolume RootFS %s is not staged, skip", rootfsID)
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	} else if err != nil {
+		return nil, status.Errorf(codes.Internal, "Load RootFS %s failed: %v", rootfsID, err)
+	}
+
+	// 先检查设备是否被使用（不包括 staging path 的挂载），确定要断开设备后再卸载 staging path
+	if err := ns.checkInUse(ctx, rootfsID, rootfs); err != nil {
+		return nil, err
+	}
+
+	if err := ns.unmountStaging(rootfs.Base()); err != nil {
+		return nil, status.Errorf(codes.Internal, "Unmount RootFS %s failed: %v", rootfsID, err)
+	}
+
+	if err := rootfs.Disconnect(); err != nil {
+		return nil, status.Errorf(codes.Internal, "Disconnect RootFS %s failed: %v", rootfsID, err)
+	}
+
+	if err := rootfs.WriteConfig(); err != nil {
+		return nil, status.Errorf(codes.Internal, "Write RootFS %s config failed: %v", rootfsID, err)
+	}
+
+	log.DebugLog(ctx, "NodeUnstageVolume RootFS %s success", rootfsID)
+
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+// checkInUse 设备仍被容器运行时等使用时返回可重试的错误，避免断开正在运行的容器的根磁盘
+func (ns *NodeServer) checkInUse(ctx context.Context, rootfsID string, rootfs RootFS) error {
+
+	holders, err := rootfs.Holders()
+	if err != nil {
+		return status.Errorf(codes.Internal, "Check holders of RootFS %s failed: %v", rootfsID, err)
+	}
+
+	ns.inUseMutex.Lock()
+	defer ns.inUseMutex.Unlock()
+
+	if len(holders) == 0 {
+		delete(ns.inUseSince, rootfsID)
+		return nil
+	}
+
+	since, ok := ns.inUseSince[rootfsID]
+	if !ok {
+		since = time.Now()
+		ns.inUseSince[rootfsID] = since
+	}
+
+	if ns.forceDetachGracePeriod > 0 && time.Since(since) >= ns.forceDetachGracePeriod {
+		log.WarningLog(ctx, "RootFS %s is still in use after %v, force detach: %s", rootfsID, ns.forceDetachGracePeriod, strings.Join(holders, "; "))
+		delete(ns.inUseSince, rootfsID)
+		return nil
+	}
+
+	return status.Errorf(codes.FailedPrecondition, "RootFS %s is in use: %s", rootfsID, strings.Join(holders, "; "))
+}
+
+// NodePublishVolume 将已经连接的 rootfs 发布到 Pod 的 target path，不涉及设备的连接
+func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+
+	if err := ns.validateNodePublishVolumeRequest(req); err != nil {
+		return nil, err
+	}
+
+	rootfsID := req.VolumeId
+
+	if acquired := ns.rootfsLock.TryAcquire(rootfsID); !acquired {
+		return nil, status.Errorf(codes.Aborted, "an operation with the given Volume ID %s already exists", rootfsID)
+	}
+	defer ns.rootfsLock.Release(rootfsID)
+
+	rootfs, err := LoadRootFS(rootfsID, ns.basePath)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "RootFS %s is not staged: %v", rootfsID, err)
+	}
+
+	base := rootfs.Base()
+	if base.Disk == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "RootFS %s is not connected", rootfsID)
+	}
+
+	if err := validateAccessModes(base.RootFSType, []*csi.VolumeCapability{req.GetVolumeCapability()}); err != nil {
+		return nil, err
+	}
+
+	readOnly := req.GetReadonly() || base.ReadOnly
+
+	switch {
+	case req.GetVolumeCapability().GetBlock() != nil:
+		err = ns.bindTarget(base.Disk, req.GetTargetPath(), true, readOnly)
+	case base.MountPath != "":
+		err = ns.bindTarget(base.MountPath, req.GetTargetPath(), false, readOnly)
+	default:
+		// 只通过输出文件使用 rootfs 时，target path 仅用于满足 kubelet 的检查
+		err = os.MkdirAll(req.GetTargetPath(), 0750)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Publish RootFS %s to %s failed: %v", rootfsID, req.GetTargetPath(), err)
+	}
+
+	// 通过输出文件使用 rootfs 的运行时根据 read_only 决定是否只读挂载
+	if readOnly, ok := base.Publishes[req.GetTargetPath()]; !ok || readOnly != req.GetReadonly() {
+		if base.Publishes == nil {
+			base.Publishes = make(map[string]bool)
+		}
+		base.Publishes[req.GetTargetPath()] = req.GetReadonly()
+		if err = rootfs.WriteConfig(); err != nil {
+			return nil, status.Errorf(codes.Internal, "Write RootFS %s config failed: %v", rootfsID, err)
+		}
+	}
+
+	log.DebugLog(ctx, "NodePublishVolume RootFS %s to %s success", rootfsID, req.GetTargetPath())
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
+
 func (ns *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 
 	if err := ns.validateNodeUnpublishVolumeRequest(req); err != nil {
 		return nil, err
 	}
 
-	// 由于 UnpublishVolume 只会传 PV 名称，因此这里使用 PV 的名称作为 rootfs 的 ID
 	rootfsID := req.VolumeId
 
 	if acquired := ns.rootfsLock.TryAcquire(rootfsID); !acquired {
@@ -71,27 +306,211 @@ func (ns *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	}
 	defer ns.rootfsLock.Release(rootfsID)
 
-	rootfs, err := LoadRootFS(rootfsID, ns.basePath)
+	if err := ns.unbindTarget(req.GetTargetPath()); err != nil {
+		return nil, status.Errorf(codes.Internal, "Unpublish RootFS %s from %s failed: %v", rootfsID, req.GetTargetPath(), err)
+	}
+
+	// rootfs 已经 unstage 时不需要更新 publish 记录
+	if rootfs, err := LoadRootFS(rootfsID, ns.basePath); err == nil {
+		base := rootfs.Base()
+		if _, ok := base.Publishes[req.GetTargetPath()]; ok {
+			delete(base.Publishes, req.GetTargetPath())
+			if err = rootfs.WriteConfig(); err != nil {
+				return nil, status.Errorf(codes.Internal, "Write RootFS %s config failed: %v", rootfsID, err)
+			}
+		}
+	}
 
+	log.DebugLog(ctx, "NodeUnpublishVolume RootFS %s from %s success", rootfsID, req.GetTargetPath())
+
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+func (ns *NodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+
+	if err := ns.validateNodeExpandVolumeRequest(req); err != nil {
+		return nil, err
+	}
+
+	rootfsID := req.VolumeId
+
+	if acquired := ns.rootfsLock.TryAcquire(rootfsID); !acquired {
+		return nil, status.Errorf(codes.Aborted, "an operation with the given Volume ID %s already exists", rootfsID)
+	}
+	defer ns.rootfsLock.Release(rootfsID)
+
+	if err := ns.operationLocks.GetExpandLock(rootfsID); err != nil {
+		return nil, status.Error(codes.Aborted, err.Error())
+	}
+	defer ns.operationLocks.ReleaseExpandLock(rootfsID)
+
+	rootfs, err := LoadRootFS(rootfsID, ns.basePath)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Load RootFS %s failed: %v", rootfsID, err)
+		return nil, status.Errorf(codes.NotFound, "Load RootFS %s failed: %v", rootfsID, err)
 	}
 
-	if err := rootfs.Disconnect(); err != nil {
-		return nil, status.Errorf(codes.Internal, "Write RootFS %s config failed: %v", rootfsID, err)
+	capacity, err := rootfs.Expand(req.GetCapacityRange().GetRequiredBytes())
+	if errors.Is(err, errDeviceConnected) {
+		// 记录目标大小，卷下次 stage 时在连接前扩容
+		if err = rootfs.WriteConfig(); err != nil {
+			return nil, status.Errorf(codes.Internal, "Write RootFS %s config failed: %v", rootfsID, err)
+		}
+		return nil, status.Errorf(codes.FailedPrecondition, "RootFS %s is staged and cannot be expanded online, the new size will be applied on next stage", rootfsID)
+	} else if err != nil {
+		return nil, status.Errorf(codes.Internal, "Expand RootFS %s failed: %v", rootfsID, err)
 	}
 
 	if err := rootfs.WriteConfig(); err != nil {
 		return nil, status.Errorf(codes.Internal, "Write RootFS %s config failed: %v", rootfsID, err)
 	}
 
-	return &csi.NodeUnpublishVolumeResponse{}, nil
+	log.DebugLog(ctx, "NodeExpandVolume RootFS %s to %d success", rootfsID, capacity)
+
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: capacity}, nil
+}
+
+// NodeGetVolumeStats 返回设备容量；文件系统挂载时返回文件系统的使用量，否则 qemu 卷返回 overlay 实际占用的空间。
+// 设备的健康状态和 overlay 的占用通过 VolumeCondition 返回。
+func (ns *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+
+	if req.GetVolumeId() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "volume ID cannot be empty")
+	}
+
+	if req.GetVolumePath() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "volume path cannot be empty")
+	}
+
+	rootfsID := req.VolumeId
+
+	rootfs, err := LoadRootFS(rootfsID, ns.basePath)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "Load RootFS %s failed: %v", rootfsID, err)
+	}
+
+	if _, err = os.Stat(req.GetVolumePath()); err != nil {
+		return nil, status.Errorf(codes.NotFound, "Volume path %s of RootFS %s not found: %v", req.GetVolumePath(), rootfsID, err)
+	}
+
+	capacity, allocated, err := rootfs.Usage()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Get usage of RootFS %s failed: %v", rootfsID, err)
+	}
+
+	condition := &csi.VolumeCondition{Message: "rootfs is healthy"}
+	if err = rootfs.Healthy(); err != nil {
+		condition = &csi.VolumeCondition{Abnormal: true, Message: err.Error()}
+	}
+	if allocated >= 0 {
+		condition.Message = fmt.Sprintf("%s, overlay allocated %d bytes", condition.Message, allocated)
+	}
+
+	// 挂载了文件系统时，以文件系统的使用量为准
+	if mountPath := rootfs.Base().MountPath; mountPath != "" {
+		usage, err := fileSystemUsage(mountPath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Get file system usage of RootFS %s failed: %v", rootfsID, err)
+		}
+		return &csi.NodeGetVolumeStatsResponse{Usage: usage, VolumeCondition: condition}, nil
+	}
+
+	usage := &csi.VolumeUsage{Unit: csi.VolumeUsage_BYTES, Total: capacity}
+	if allocated >= 0 {
+		usage.Used = allocated
+		if capacity > allocated {
+			usage.Available = capacity - allocated
+		}
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{Usage: []*csi.VolumeUsage{usage}, VolumeCondition: condition}, nil
+}
+
+func fileSystemUsage(path string) ([]*csi.VolumeUsage, error) {
+
+	st := &unix.Statfs_t{}
+	if err := unix.Statfs(path, st); err != nil {
+		return nil, err
+	}
+
+	bsize := int64(st.Bsize)
+	return []*csi.VolumeUsage{
+		{
+			Unit:      csi.VolumeUsage_BYTES,
+			Total:     int64(st.Blocks) * bsize,
+			Available: int64(st.Bavail) * bsize,
+			Used:      int64(st.Blocks-st.Bfree) * bsize,
+		},
+		{
+			Unit:      csi.VolumeUsage_INODES,
+			Total:     int64(st.Files),
+			Available: int64(st.Ffree),
+			Used:      int64(st.Files - st.Ffree),
+		},
+	}, nil
+}
+
+// ensureImage 在本地缺失基础镜像时从下载源拉取并校验，克隆和恢复使用来源的基础镜像，不需要处理
+func (ns *NodeServer) ensureImage(ctx context.Context, volContext map[string]string) error {
+
+	if volContext[RootFSTypeKey] != RootfsTypeQemu {
+		return nil
+	}
+
+	if volContext[qemuSourceSnapshotKey] != "" || volContext[qemuSourceVolumeKey] != "" {
+		return nil
+	}
+
+	name := volContext[qemuImageKey]
+	if _, err := ns.images.Ensure(ctx, name); err != nil {
+		return status.Errorf(codes.Internal, "Prepare image %s failed: %v", name, err)
+	}
+
+	// 镜像与 StorageClass 中指定的摘要或者签名不一致时拒绝创建 overlay
+	if err := ns.images.Verify(name, volContext[qemuImageDigestKey]); err != nil {
+		return status.Errorf(codes.FailedPrecondition, "Verify image %s failed: %v", name, err)
+	}
+
+	return nil
+}
+
+func (ns *NodeServer) validateNodeStageVolumeRequest(request *csi.NodeStageVolumeRequest) error {
+
+	if err := validateVolumeCapability(request.GetVolumeCapability()); err != nil {
+		return err
+	}
+
+	if request.GetVolumeId() == "" {
+		return status.Errorf(codes.InvalidArgument, "volume ID cannot be empty")
+	}
+
+	if request.GetStagingTargetPath() == "" {
+		return status.Errorf(codes.InvalidArgument, "staging target path cannot be empty")
+	}
+
+	if err := ns.validateFromVolContext(request.VolumeContext); err != nil {
+		return err
+	}
+
+	return validateAccessModes(request.VolumeContext[RootFSTypeKey], []*csi.VolumeCapability{request.GetVolumeCapability()})
+}
+
+func (ns *NodeServer) validateNodeUnstageVolumeRequest(request *csi.NodeUnstageVolumeRequest) error {
+
+	if request.GetVolumeId() == "" {
+		return status.Errorf(codes.InvalidArgument, "volume ID cannot be empty")
+	}
+
+	if request.GetStagingTargetPath() == "" {
+		return status.Errorf(codes.InvalidArgument, "staging target path cannot be empty")
+	}
+
+	return nil
 }
 
 func (ns *NodeServer) validateNodePublishVolumeRequest(request *csi.NodePublishVolumeRequest) error {
 
-	if request.GetVolumeCapability() == nil {
-		return status.Errorf(codes.InvalidArgument, "volume capability cannot be empty")
+	if err := validateVolumeCapability(request.GetVolumeCapability()); err != nil {
+		return err
 	}
 
 	if request.GetVolumeId() == "" {
@@ -102,10 +521,24 @@ func (ns *NodeServer) validateNodePublishVolumeRequest(request *csi.NodePublishV
 		return status.Errorf(codes.InvalidArgument, "target path cannot be empty")
 	}
 
-	//if request.GetStagingTargetPath() == "" {
-	//	return status.Errorf(codes.FailedPrecondition, "staging target path cannot be empty")
-	//}
-	return ns.validateFromVolContext(request.VolumeContext)
+	if request.GetStagingTargetPath() == "" {
+		return status.Errorf(codes.FailedPrecondition, "staging target path cannot be empty")
+	}
+
+	return nil
+}
+
+func validateVolumeCapability(capability *csi.VolumeCapability) error {
+
+	if capability == nil {
+		return status.Errorf(codes.InvalidArgument, "volume capability cannot be empty")
+	}
+
+	if capability.GetBlock() == nil && capability.GetMount() == nil {
+		return status.Errorf(codes.InvalidArgument, "volume access type must be block or mount")
+	}
+
+	return nil
 }
 
 func (ns *NodeServer) validateNodeUnpublishVolumeRequest(request *csi.NodeUnpublishVolumeRequest) error {
@@ -121,19 +554,20 @@ func (ns *NodeServer) validateNodeUnpublishVolumeRequest(request *csi.NodeUnpubl
 	return nil
 }
 
-func (ns *NodeServer) validateFromVolContext(volContext map[string]string) error {
-
-	//rootfsImage := volContext[RootFSImageKey]
-	//if rootfsImage == "" {
-	//	return status.Errorf(codes.InvalidArgument, "rootfs image is empty")
-	//}
+func (ns *NodeServer) validateNodeExpandVolumeRequest(request *csi.NodeExpandVolumeRequest) error {
 
-	rootfsType := volContext[RootFSTypeKey]
+	if request.GetVolumeId() == "" {
+		return status.Errorf(codes.InvalidArgument, "volume ID cannot be empty")
+	}
 
-	switch rootfsType {
-	case RootfsTypeISCSI, RootfsTypeQemu:
-		return nil
-	default:
-		return status.Errorf(codes.InvalidArgument, "error rootfs type %s", rootfsType)
+	if request.GetCapacityRange() == nil {
+		return status.Errorf(codes.InvalidArgument, "capacity range cannot be empty")
 	}
+
+	return nil
+}
+
+func (ns *NodeServer) validateFromVolContext(volContext map[string]string) error {
+
+	return validateParameters(volContext)
 }
@@ -0,0 +1,38 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/QQGoblin/extrootfs/pkg/utils/lock"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestNodeUnstageVolumeIdempotent(t *testing.T) {
+
+	basePath := t.TempDir()
+	ns := &NodeServer{
+		basePath:       basePath,
+		rootfsLock:     lock.NewVolumeLocks(),
+		operationLocks: lock.NewOperationLock(),
+	}
+
+	// 没有 stage 过的卷，以及只创建了数据目录、还没有写入配置的卷
+	if err := os.MkdirAll(path.Join(basePath, "pvc-partial"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(basePath, "pvc-partial", DefaultTypeFile), []byte(RootfsTypeQemu), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"pvc-missing", "pvc-partial"} {
+		req := &csi.NodeUnstageVolumeRequest{VolumeId: id, StagingTargetPath: path.Join(t.TempDir(), "staging")}
+		for i := 0; i < 2; i++ {
+			if _, err := ns.NodeUnstageVolume(context.Background(), req); err != nil {
+				t.Errorf("NodeUnstageVolume %s #%d: %v", id, i, err)
+			}
+		}
+	}
+}
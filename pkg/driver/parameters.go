@@ -0,0 +1,184 @@
+package driver
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/QQGoblin/extrootfs/pkg/array"
+	"github.com/QQGoblin/extrootfs/pkg/image"
+	"github.com/QQGoblin/extrootfs/pkg/utils/blkid"
+	"github.com/QQGoblin/extrootfs/pkg/utils/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type parameterKind int
+
+const (
+	parameterString parameterKind = iota
+	parameterInt
+	parameterBool
+)
+
+// parameter 描述 StorageClass 中的一个参数
+type parameter struct {
+	key      string
+	kind     parameterKind
+	required bool
+	// requiredUnless 中任意一个参数存在时，该参数不是必须的
+	requiredUnless []string
+	// values 非空时参数只能取其中的值
+	values []string
+	// validate 检查参数值的格式
+	validate func(string) error
+}
+
+// 由 CO 添加到参数中的键，不属于 StorageClass 的参数
+var externalParameterPrefixes = []string{
+	"csi.storage.k8s.io/",
+	"storage.kubernetes.io/",
+}
+
+var commonParameters = []parameter{
+	{key: RootFSTypeKey, required: true, values: []string{RootfsTypeQemu, RootfsTypeISCSI}},
+	{key: RootPartitionKey, validate: func(v string) error {
+		_, err := blkid.ParseSelector(v)
+		return err
+	}},
+	{key: mountTargetKey, kind: parameterBool},
+}
+
+var rootfsParameters = map[string][]parameter{
+	RootfsTypeQemu: {
+		{key: qemuImageKey, required: true, requiredUnless: []string{qemuSourceSnapshotKey, qemuSourceVolumeKey}},
+		{key: qemuImageDigestKey, validate: image.ValidateDigest},
+		{key: qemuSourceSnapshotKey, validate: func(v string) error {
+			_, _, err := parseSnapshotID(v)
+			return err
+		}},
+		{key: qemuSourceVolumeKey},
+	},
+	RootfsTypeISCSI: {
+		{key: iscsiTargetKey, required: true, requiredUnless: []string{arrayKey}},
+		{key: iscsiPortalKey, required: true, requiredUnless: []string{arrayKey}},
+		{key: iscsiLunKey, kind: parameterInt, required: true, requiredUnless: []string{arrayKey}, validate: func(v string) error {
+			if lun, _ := strconv.Atoi(v); lun < 0 {
+				return fmt.Errorf("lun must not be negative")
+			}
+			return nil
+		}},
+		{key: iscsiUserKey},
+		{key: iscsiPasswordKey},
+		{key: iscsiPreemptLunKey, kind: parameterBool},
+		{key: arrayKey, validate: array.ValidateName},
+		{key: arraySourceKey, validate: array.ValidateName},
+	},
+}
+
+// validateParameters 按照 rootfs 类型检查参数，controller 和 node 共用。
+// 未知的参数只记录警告，方便新旧版本的 StorageClass 共存。
+func validateParameters(params map[string]string) error {
+
+	if err := checkParameters(commonParameters, params); err != nil {
+		return err
+	}
+
+	schema := rootfsParameters[params[RootFSTypeKey]]
+	if err := checkParameters(schema, params); err != nil {
+		return err
+	}
+
+	known := make(map[string]bool)
+	for _, s := range [][]parameter{commonParameters, schema} {
+		for _, p := range s {
+			known[p.key] = true
+		}
+	}
+
+	var unknown []string
+	for key := range params {
+		if !known[key] && !isExternalParameter(key) {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		log.WarningLogMsg("Unknown parameters for %s rootfs: %s", params[RootFSTypeKey], strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
+
+func checkParameters(schema []parameter, params map[string]string) error {
+
+	for _, p := range schema {
+		value, ok := params[p.key]
+		if !ok || value == "" {
+			if p.required && !anyParameter(params, p.requiredUnless) {
+				return status.Errorf(codes.InvalidArgument, "parameter %s is required", p.key)
+			}
+			continue
+		}
+
+		if err := p.check(value); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid parameter %s=%q: %v", p.key, value, err)
+		}
+	}
+
+	return nil
+}
+
+func (p *parameter) check(value string) error {
+
+	switch p.kind {
+	case parameterInt:
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Errorf("must be an integer")
+		}
+	case parameterBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("must be a boolean")
+		}
+	}
+
+	if len(p.values) > 0 {
+		for _, v := range p.values {
+			if value == v {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %s", strings.Join(p.values, ", "))
+	}
+
+	if p.validate != nil {
+		return p.validate(value)
+	}
+
+	return nil
+}
+
+func anyParameter(params map[string]string, keys []string) bool {
+	for _, key := range keys {
+		if params[key] != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func isExternalParameter(key string) bool {
+	for _, prefix := range externalParameterPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// boolParameter 解析布尔参数，参数已经通过 validateParameters 检查
+func boolParameter(params map[string]string, key string) bool {
+	b, _ := strconv.ParseBool(params[key])
+	return b
+}
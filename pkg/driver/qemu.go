@@ -2,12 +2,14 @@ package driver
 
 import (
 	"encoding/json"
+	"github.com/QQGoblin/extrootfs/pkg/utils"
 	"github.com/QQGoblin/extrootfs/pkg/utils/log"
 	"github.com/QQGoblin/extrootfs/pkg/utils/qemu"
 	"github.com/pkg/errors"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 )
 
 type QEMURootFS struct {
@@ -16,13 +18,22 @@ type QEMURootFS struct {
 	RootFSPath string        `json:"rootfs_path"`
 	BaseInfo   *qemu.ImgInfo `json:"base_info"`
 	NBD        *qemu.NBD     `json:"nbd_info"`
+	Size       int64         `json:"size"`
+	// 通过快照恢复或者克隆其他 rootfs 创建 overlay 时的数据来源
+	SourceSnapshot string `json:"source_snapshot,omitempty"`
+	SourceVolume   string `json:"source_volume,omitempty"`
 }
 
 var _ RootFS = &QEMURootFS{}
 
 const (
-	qemuConfig   = "qemu-config.json"
-	qemuImageKey = "extrootfs.io/qemu/image"
+	qemuConfig            = "qemu-config.json"
+	qemuImageKey          = "extrootfs.io/qemu/image"
+	qemuImageDigestKey    = "extrootfs.io/qemu/image-digest"
+	qemuSourceSnapshotKey = "extrootfs.io/qemu/source-snapshot"
+	qemuSourceVolumeKey   = "extrootfs.io/qemu/source-volume"
+	// qemuSizeKey ControllerPublishVolume 在 publish context 中返回的卷容量，NodeStageVolume 连接前扩容 overlay
+	qemuSizeKey = "extrootfs.io/qemu/size"
 )
 
 func NewQEMURootFS(rootfsID, basePath, outputBase string, config map[string]string) (RootFS, error) {
@@ -34,9 +45,29 @@ func NewQEMURootFS(rootfsID, basePath, outputBase string, config map[string]stri
 
 	image := config[qemuImageKey]
 	rootfs := &QEMURootFS{
-		BaseRootFS: *base,
-		ImagePath:  path.Join(basePath, RootfsTypeQemu, DefaultImagesDir, image),
-		RootFSPath: path.Join(basePath, rootfsID, DefaultRootFSFile),
+		BaseRootFS:     *base,
+		ImagePath:      NewImageStore(basePath).Path(image),
+		RootFSPath:     path.Join(basePath, rootfsID, DefaultRootFSFile),
+		SourceSnapshot: config[qemuSourceSnapshotKey],
+		SourceVolume:   config[qemuSourceVolumeKey],
+	}
+
+	// 扩容请求可能在设备连接时到达，此时记录的目标大小需要在下次连接前生效
+	old, err := LoadQEMURootFS(base.DataPath)
+	if err == nil {
+		rootfs.Size = old.Size
+	}
+	if size, err := strconv.ParseInt(config[qemuSizeKey], 10, 64); err == nil && size > rootfs.Size {
+		rootfs.Size = size
+	}
+
+	// overlay 已经存在时基础镜像以 overlay 的 backing file 为准，克隆和恢复得到的 overlay 使用来源的基础镜像
+	if _, err := os.Stat(rootfs.RootFSPath); err == nil {
+		if backing, err := qemu.BackingFile(rootfs.RootFSPath); err == nil && backing != "" {
+			rootfs.ImagePath = backing
+		} else if old != nil && old.ImagePath != "" {
+			rootfs.ImagePath = old.ImagePath
+		}
 	}
 
 	return rootfs, nil
@@ -45,29 +76,115 @@ func NewQEMURootFS(rootfsID, basePath, outputBase string, config map[string]stri
 func (q *QEMURootFS) Allocate() error {
 
 	var err error
+	if _, err = os.Stat(q.RootFSPath); os.IsNotExist(err) {
+		err = q.createOverlay()
+	}
+	if err != nil {
+		return err
+	}
+
 	if q.BaseInfo, err = qemu.ImageInfo(q.ImagePath); err != nil {
 		return err
 	}
 
-	if _, err = os.Stat(q.RootFSPath); os.IsNotExist(err) {
-		_, createErr := qemu.CreateImageFromBase(q.RootFSPath, q.ImagePath)
-		return createErr
+	// 从 OCI 镜像构建的基础镜像在元数据中记录了文件系统类型
+	if manifest, err := NewImageStore(path.Dir(q.DataPath)).LoadManifest(filepath.Base(q.ImagePath)); err == nil {
+		q.FileSystemType = manifest.FileSystemType
 	}
 
+	return q.resize()
+}
+
+// createOverlay 创建 overlay，克隆和恢复得到的 overlay 使用来源的基础镜像作为 backing file
+func (q *QEMURootFS) createOverlay() error {
+
+	basePath := path.Dir(q.DataPath)
+
+	switch {
+	case q.SourceSnapshot != "":
+		snapshot, err := LoadSnapshot(q.SourceSnapshot, basePath)
+		if err != nil {
+			return errors.Wrapf(err, "load source snapshot %s", q.SourceSnapshot)
+		}
+		if snapshot.InProgress {
+			return errors.Errorf("snapshot %s is not ready", q.SourceSnapshot)
+		}
+		q.ImagePath = snapshot.ImagePath
+		log.DefaultLog("Restore %s from snapshot %s", q.RootFSPath, snapshot.ID)
+		return qemu.CopyImageWithBacking(q.RootFSPath, snapshot.SnapshotPath, q.ImagePath)
+	case q.SourceVolume != "":
+		source, err := LoadQEMURootFS(path.Join(basePath, q.SourceVolume))
+		if err != nil {
+			return errors.Wrapf(err, "load source rootfs %s", q.SourceVolume)
+		}
+		q.ImagePath = source.ImagePath
+		log.DefaultLog("Clone %s from rootfs %s", q.RootFSPath, source.ID)
+		return source.Snapshot(q.RootFSPath)
+	}
+
+	_, err := qemu.CreateImageFromBase(q.RootFSPath, q.ImagePath)
 	return err
 }
 
+// resize 将 overlay 调整到记录的目标大小，只允许在 NBD 断开时执行
+func (q *QEMURootFS) resize() error {
+
+	if q.Size == 0 {
+		return nil
+	}
+
+	// 先检查导出状态，qemu-nbd 持有 overlay 的写锁，qemu-img 无法打开正在导出的 overlay
+	if nbd, err := qemu.FindNBD(q.RootFSPath); err != nil {
+		return err
+	} else if nbd != nil {
+		log.WarningLogMsg("RootFS %s is connected to %s, resize to %d will take effect on next connect", q.ID, nbd.DevicePath, q.Size)
+		return nil
+	}
+
+	info, err := qemu.ImageInfo(q.RootFSPath)
+	if err != nil {
+		return err
+	}
+
+	if info.VirtualSize >= q.Size {
+		return nil
+	}
+
+	log.DefaultLog("Resize %s from %d to %d", q.RootFSPath, info.VirtualSize, q.Size)
+	return qemu.ResizeImage(q.RootFSPath, q.Size)
+}
+
 func (q *QEMURootFS) Connect() error {
 
-	q.NBD = &qemu.NBD{}
 	// TODO: lock!!
 	qemu.NBDConnectLock.Lock()
 	defer qemu.NBDConnectLock.Unlock()
 
-	if err := q.NBD.Connect(q.RootFSPath, q.BaseInfo.Format); err != nil {
+	// 配置文件写入前进程退出时，overlay 可能仍然被导出，同一个 overlay 连接两个 NBD 设备会损坏镜像
+	nbd, err := qemu.FindNBD(q.RootFSPath)
+	if err != nil {
+		return err
+	}
+	if nbd != nil {
+		// 已经导出的设备可能正在被使用，不能断开后按照要求的方式重新连接
+		if nbd.ReadOnly() != q.ReadOnly {
+			return errors.Errorf("rootfs %s is already connected to %s with read-only %t", q.ID, nbd.DevicePath, nbd.ReadOnly())
+		}
+		log.WarningLogMsg("RootFS %s is already connected to %s, reuse it", q.ID, nbd.DevicePath)
+		q.NBD = nbd
+	} else {
+		q.NBD = &qemu.NBD{}
+		if err = q.NBD.Connect(q.RootFSPath, q.BaseInfo.Format, q.ReadOnly); err != nil {
+			return err
+		}
+	}
+	if err := q.probeRootDevice(q.NBD.DevicePath); err != nil {
+		_ = q.NBD.Disconnect()
+		q.NBD = nil
+		q.Device = ""
+		q.Disk = ""
 		return err
 	}
-	q.Device = q.NBD.DevicePath
 	return nil
 
 }
@@ -88,6 +205,7 @@ func (q *QEMURootFS) WriteConfig() error {
 func (q *QEMURootFS) Disconnect() error {
 
 	q.Device = ""
+	q.Disk = ""
 	if q.NBD == nil {
 		return nil
 	}
@@ -100,9 +218,133 @@ func (q *QEMURootFS) Disconnect() error {
 
 }
 
+func (q *QEMURootFS) Healthy() error {
+	if q.NBD == nil {
+		return errors.Errorf("rootfs %s is not connected", q.ID)
+	}
+	return q.NBD.Check(q.RootFSPath)
+}
+
+func (q *QEMURootFS) Holders() ([]string, error) {
+
+	if q.Disk == "" {
+		return nil, nil
+	}
+
+	// qemu-nbd 进程本身打开了 NBD 设备
+	var exclude []int
+	if q.NBD != nil {
+		if pid, err := strconv.Atoi(q.NBD.PID); err == nil {
+			exclude = append(exclude, pid)
+		}
+	}
+
+	return utils.DeviceHolders(q.Disk, q.ownMounts(), exclude...)
+}
+
+func (q *QEMURootFS) Usage() (int64, int64, error) {
+
+	capacity := q.Size
+	if q.Disk != "" {
+		size, err := utils.GetBlockDeviceSize(q.Disk)
+		if err != nil {
+			return 0, 0, err
+		}
+		capacity = size
+	} else if q.BaseInfo != nil && q.BaseInfo.VirtualSize > capacity {
+		capacity = q.BaseInfo.VirtualSize
+	}
+
+	// overlay 在宿主机文件系统上实际分配的空间，即 rootfs 相对基础镜像的变化量
+	allocated, err := utils.AllocatedBytes(q.RootFSPath)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return capacity, allocated, nil
+}
+
+func (q *QEMURootFS) Matches(config map[string]string) error {
+
+	if config[RootFSTypeKey] != RootfsTypeQemu {
+		return errors.Errorf("rootfs %s is %s, not %s", q.ID, RootfsTypeQemu, config[RootFSTypeKey])
+	}
+
+	if q.SourceSnapshot != config[qemuSourceSnapshotKey] || q.SourceVolume != config[qemuSourceVolumeKey] {
+		return errors.Errorf("rootfs %s is created from a different source", q.ID)
+	}
+
+	// 克隆和恢复得到的 overlay 使用来源的基础镜像
+	if q.SourceSnapshot == "" && q.SourceVolume == "" {
+		if image := NewImageStore(path.Dir(q.DataPath)).Path(config[qemuImageKey]); image != q.ImagePath {
+			return errors.Errorf("rootfs %s uses image %s, not %s", q.ID, q.ImagePath, image)
+		}
+	}
+
+	return nil
+}
+
+func (q *QEMURootFS) Expand(size int64) (int64, error) {
+
+	if size > q.Size {
+		q.Size = size
+	}
+
+	// qemu-nbd 不支持在线调整导出设备的大小，设备连接时记录目标大小，下次连接前扩容
+	if q.NBD != nil && q.NBD.DevicePath != "" {
+		capacity, err := utils.GetBlockDeviceSize(q.NBD.DevicePath)
+		if err != nil {
+			return 0, errors.Wrap(err, "expand")
+		}
+		if capacity >= size {
+			return capacity, nil
+		}
+		return 0, errors.Wrapf(errDeviceConnected, "rootfs %s is connected to %s", q.ID, q.NBD.DevicePath)
+	}
+
+	if err := q.resize(); err != nil {
+		return 0, errors.Wrap(err, "expand")
+	}
+
+	info, err := qemu.ImageInfo(q.RootFSPath)
+	if err != nil {
+		return 0, errors.Wrap(err, "expand")
+	}
+
+	return info.VirtualSize, nil
+}
+
+// Snapshot 将 overlay 导出为以基础镜像为 backing file 的快照文件。
+// 设备连接时只刷新根设备的缓存后以 force-share 方式复制，不冻结文件系统，得到的是崩溃一致性的快照。
+func (q *QEMURootFS) Snapshot(dest string) error {
+
+	if q.Device != "" {
+		if err := utils.FlushBlockDevice(q.Device); err != nil {
+			return errors.Wrap(err, "snapshot")
+		}
+	}
+
+	if err := qemu.CopyImageWithBacking(dest, q.RootFSPath, q.ImagePath); err != nil {
+		return errors.Wrap(err, "snapshot")
+	}
+
+	return nil
+}
+
+// Cleanup 删除 rootfs 的数据目录，设备连接或者源卷正在创建快照时拒绝删除
 func (q *QEMURootFS) Cleanup() error {
-	//TODO implement me
-	panic("implement me")
+
+	if q.NBD != nil && q.NBD.DevicePath != "" {
+		return errors.Wrapf(errDeviceConnected, "rootfs %s is connected to %s", q.ID, q.NBD.DevicePath)
+	}
+
+	if id, err := snapshotInProgress(q.ID, path.Dir(q.DataPath)); err != nil {
+		return errors.Wrap(err, "cleanup")
+	} else if id != "" {
+		return errors.Wrapf(errSnapshotInProgress, "rootfs %s is being snapshotted by %s", q.ID, id)
+	}
+
+	return os.RemoveAll(q.DataPath)
 }
 
 func LoadQEMURootFS(dataPath string) (*QEMURootFS, error) {
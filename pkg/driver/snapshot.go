@@ -0,0 +1,158 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultSnapshotsDir = "snapshots"
+
+	// 快照 ID 中快照名称与节点名称的分隔符，CSI 生成的名称和 Kubernetes 节点名称中都不会出现该字符
+	snapshotIDSeparator = "_"
+	snapshotFileSuffix  = ".qcow2"
+	snapshotMetaSuffix  = ".json"
+)
+
+// Snapshot 记录保存在节点上的 rootfs 快照
+type Snapshot struct {
+	ID             string    `json:"id"`
+	Name           string    `json:"name"`
+	NodeID         string    `json:"node_id"`
+	SourceVolumeID string    `json:"source_volume_id"`
+	ImagePath      string    `json:"image_path"`
+	SnapshotPath   string    `json:"snapshot_path"`
+	Size           int64     `json:"size"`
+	CreationTime   time.Time `json:"creation_time"`
+	// InProgress 快照文件正在写入，节点上删除源卷和从快照恢复时检查该记录
+	InProgress bool `json:"in_progress,omitempty"`
+}
+
+// 快照文件只保存在创建快照的节点上，因此快照 ID 中需要记录节点名称
+func snapshotID(name, nodeID string) string {
+	return name + snapshotIDSeparator + nodeID
+}
+
+func parseSnapshotID(id string) (string, string, error) {
+	s := strings.SplitN(id, snapshotIDSeparator, 2)
+	if len(s) != 2 || s[0] == "" || s[1] == "" {
+		return "", "", fmt.Errorf("invalid snapshot id %s", id)
+	}
+	return s[0], s[1], nil
+}
+
+func snapshotDir(basePath string) string {
+	return path.Join(basePath, RootfsTypeQemu, DefaultSnapshotsDir)
+}
+
+func NewSnapshot(name, nodeID, basePath string, source *QEMURootFS) *Snapshot {
+	id := snapshotID(name, nodeID)
+	size := source.BaseInfo.VirtualSize
+	if source.Size > size {
+		size = source.Size
+	}
+	return &Snapshot{
+		ID:             id,
+		Name:           name,
+		NodeID:         nodeID,
+		SourceVolumeID: source.ID,
+		ImagePath:      source.ImagePath,
+		SnapshotPath:   path.Join(snapshotDir(basePath), id+snapshotFileSuffix),
+		Size:           size,
+		CreationTime:   time.Now(),
+	}
+}
+
+func (s *Snapshot) ToCSI() *csi.Snapshot {
+	return &csi.Snapshot{
+		SnapshotId:     s.ID,
+		SourceVolumeId: s.SourceVolumeID,
+		SizeBytes:      s.Size,
+		CreationTime:   timestamppb.New(s.CreationTime),
+		ReadyToUse:     !s.InProgress,
+	}
+}
+
+func (s *Snapshot) WriteConfig(basePath string) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(snapshotDir(basePath), s.ID+snapshotMetaSuffix), b, 0600)
+}
+
+func (s *Snapshot) Delete(basePath string) error {
+	if err := os.Remove(s.SnapshotPath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "delete snapshot")
+	}
+	if err := os.Remove(path.Join(snapshotDir(basePath), s.ID+snapshotMetaSuffix)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "delete snapshot")
+	}
+	return nil
+}
+
+func LoadSnapshot(id, basePath string) (*Snapshot, error) {
+
+	snapshot := &Snapshot{}
+
+	b, err := os.ReadFile(path.Join(snapshotDir(basePath), id+snapshotMetaSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(b, snapshot); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// snapshotInProgress 返回 volumeID 正在创建的快照，没有时返回空字符串
+func snapshotInProgress(volumeID, basePath string) (string, error) {
+
+	snapshots, err := ListSnapshots(basePath)
+	if err != nil {
+		return "", err
+	}
+
+	for _, snapshot := range snapshots {
+		if snapshot.SourceVolumeID == volumeID && snapshot.InProgress {
+			return snapshot.ID, nil
+		}
+	}
+
+	return "", nil
+}
+
+// ListSnapshots 返回节点上保存的所有快照，按照 ID 排序
+func ListSnapshots(basePath string) ([]*Snapshot, error) {
+
+	files, err := filepath.Glob(path.Join(snapshotDir(basePath), "*"+snapshotMetaSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]*Snapshot, 0, len(files))
+	for _, file := range files {
+		snapshot, err := LoadSnapshot(strings.TrimSuffix(filepath.Base(file), snapshotMetaSuffix), basePath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "load snapshot %s", file)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].ID < snapshots[j].ID
+	})
+
+	return snapshots, nil
+}
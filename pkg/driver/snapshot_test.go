@@ -0,0 +1,61 @@
+package driver
+
+import (
+	"os"
+	"testing"
+
+	"github.com/QQGoblin/extrootfs/pkg/utils/lock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDeleteVolumeWithSnapshotInProgress(t *testing.T) {
+
+	basePath := t.TempDir()
+	cs := &ControllerServer{basePath: basePath, rootfsLock: lock.NewVolumeLocks()}
+
+	config := map[string]string{RootFSTypeKey: RootfsTypeQemu, qemuImageKey: "base.qcow2", "csi.storage.k8s.io/pvc/name": "rootfs"}
+	rootfs, err := NewQEMURootFS("pvc-1", basePath, t.TempDir(), config)
+	if err != nil {
+		t.Fatalf("NewQEMURootFS: %v", err)
+	}
+	if err = rootfs.WriteConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.MkdirAll(snapshotDir(basePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := &Snapshot{ID: snapshotID("snapshot-1", "node-1"), SourceVolumeID: "pvc-1", InProgress: true}
+	if err = snapshot.WriteConfig(basePath); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.ToCSI().GetReadyToUse() {
+		t.Error("in progress snapshot is ready to use")
+	}
+
+	// 快照记录未完成时拒绝删除源卷
+	err = cs.deleteLocalVolume("pvc-1")
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("deleteLocalVolume with snapshot in progress: %v, want FailedPrecondition", err)
+	}
+	if _, err = os.Stat(rootfs.Base().DataPath); err != nil {
+		t.Fatalf("rootfs data is removed: %v", err)
+	}
+
+	snapshot.InProgress = false
+	if err = snapshot.WriteConfig(basePath); err != nil {
+		t.Fatal(err)
+	}
+	if err = cs.deleteLocalVolume("pvc-1"); err != nil {
+		t.Fatalf("deleteLocalVolume: %v", err)
+	}
+	if _, err = os.Stat(rootfs.Base().DataPath); !os.IsNotExist(err) {
+		t.Errorf("rootfs data is not removed: %v", err)
+	}
+
+	// 数据不在当前节点上的卷
+	if err = cs.deleteLocalVolume("pvc-2"); err != nil {
+		t.Errorf("deleteLocalVolume missing volume: %v", err)
+	}
+}
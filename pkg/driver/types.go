@@ -2,6 +2,9 @@ package driver
 
 import (
 	"encoding/json"
+	"github.com/QQGoblin/extrootfs/pkg/utils"
+	"github.com/QQGoblin/extrootfs/pkg/utils/blkid"
+	"github.com/QQGoblin/extrootfs/pkg/utils/log"
 	"github.com/pkg/errors"
 	"os"
 	"path"
@@ -9,6 +12,8 @@ import (
 
 const (
 	RootFSTypeKey = "extrootfs.io/type"
+	// RootPartitionKey 指定根文件系统所在的分区，格式见 blkid.Selector，为空时自动选择
+	RootPartitionKey = "extrootfs.io/root-partition"
 
 	DefaultRootFSFile = "rootfs"
 	DefaultImagesDir  = "images"
@@ -26,8 +31,18 @@ type RootFS interface {
 	Allocate() error
 	Connect() error
 	Disconnect() error
+	Expand(size int64) (int64, error)
 	Cleanup() error
 	WriteConfig() error
+	Base() *BaseRootFS
+	// Healthy 检查已经连接的设备是否仍然可用
+	Healthy() error
+	// Matches 检查已经连接的 rootfs 是否与卷的参数一致
+	Matches(config map[string]string) error
+	// Holders 返回正在使用设备的挂载点、进程和上层设备
+	Holders() ([]string, error)
+	// Usage 返回设备容量和后端实际占用的空间，无法获取实际占用时返回 -1
+	Usage() (capacity int64, allocated int64, err error)
 }
 
 func NewRootFS(rootfsID, rootfsType, basePath, outputbase string, config map[string]string) (RootFS, error) {
@@ -63,23 +78,34 @@ func LoadRootFS(rootfsID, basePath string) (RootFS, error) {
 }
 
 type BaseRootFS struct {
-	ID             string `json:"id"`
-	PVCName        string `json:"pvc_name"`
-	Output         string `json:"output"`
-	DataPath       string `json:"data_path"`
-	RootFSType     string `json:"rootfs_type"`
-	Device         string `json:"device"`
-	FileSystemType string `json:"file_system_type"`
+	ID              string `json:"id"`
+	PVCName         string `json:"pvc_name"`
+	Output          string `json:"output"`
+	DataPath        string `json:"data_path"`
+	RootFSType      string `json:"rootfs_type"`
+	Device          string `json:"device"`
+	Disk            string `json:"disk"`
+	FileSystemType  string `json:"file_system_type"`
+	FileSystemUUID  string `json:"file_system_uuid"`
+	FileSystemLabel string `json:"file_system_label"`
+	RootPartition   string `json:"root_partition,omitempty"`
+	// 挂载到 staging path 时记录挂载点，断开设备前需要卸载
+	MountPath string `json:"mount_path,omitempty"`
+	// ReadOnly 设备以只读方式连接
+	ReadOnly bool `json:"read_only,omitempty"`
+	// Publishes 记录当前所有 publish 的 target path 以及是否要求只读
+	Publishes map[string]bool `json:"publishes,omitempty"`
 }
 
 func NewBaseRootFS(rootfsID, basePath, outputBase string, config map[string]string) (*BaseRootFS, error) {
 
 	rootfs := &BaseRootFS{
-		ID:         rootfsID,
-		PVCName:    config["csi.storage.k8s.io/pvc/name"],
-		Output:     path.Join(outputBase, config["csi.storage.k8s.io/pvc/name"]),
-		DataPath:   path.Join(basePath, rootfsID),
-		RootFSType: config[RootFSTypeKey],
+		ID:            rootfsID,
+		PVCName:       config["csi.storage.k8s.io/pvc/name"],
+		Output:        path.Join(outputBase, config["csi.storage.k8s.io/pvc/name"]),
+		DataPath:      path.Join(basePath, rootfsID),
+		RootFSType:    config[RootFSTypeKey],
+		RootPartition: config[RootPartitionKey],
 	}
 
 	if err := os.MkdirAll(rootfs.DataPath, 0755); err != nil {
@@ -96,6 +122,95 @@ func NewBaseRootFS(rootfsID, basePath, outputBase string, config map[string]stri
 type RootFSOutput struct {
 	Device         string `json:"device"`
 	FilesystemType string `json:"fs_type"`
+	UUID           string `json:"uuid,omitempty"`
+	Label          string `json:"label,omitempty"`
+	ReadOnly       bool   `json:"read_only,omitempty"`
+}
+
+func (rs *BaseRootFS) Base() *BaseRootFS {
+	return rs
+}
+
+// errDeviceConnected 表示设备连接时无法完成操作，需要先断开设备
+var errDeviceConnected = errors.New("device is connected")
+
+// errSnapshotInProgress 表示源卷正在创建快照，不能删除
+var errSnapshotInProgress = errors.New("snapshot in progress")
+
+// ownMounts 返回驱动自己的挂载点，检查设备是否被使用时不计入
+func (rs *BaseRootFS) ownMounts() []string {
+	if rs.MountPath == "" {
+		return nil
+	}
+	return []string{rs.MountPath}
+}
+
+// publishReadOnly 判断是否有 publish 要求只读，任意一个 publish 只读时 rootfs 都以只读方式使用
+func (rs *BaseRootFS) publishReadOnly() bool {
+	for _, readOnly := range rs.Publishes {
+		if readOnly {
+			return true
+		}
+	}
+	return false
+}
+
+// setReadOnly 将磁盘和根分区设置为只读，分区不会继承磁盘的只读设置
+func (rs *BaseRootFS) setReadOnly() error {
+	if err := utils.SetBlockDeviceReadOnly(rs.Disk); err != nil {
+		return err
+	}
+	if rs.Device != rs.Disk {
+		return utils.SetBlockDeviceReadOnly(rs.Device)
+	}
+	return nil
+}
+
+// probeRootDevice 识别磁盘上的根文件系统，将根文件系统所在的设备（磁盘或者分区）作为输出的设备。
+// 指定了根分区时找不到分区返回错误；否则自动选择，无法识别时输出整个磁盘，文件系统信息保持不变。
+func (rs *BaseRootFS) probeRootDevice(disk string) error {
+
+	rs.Disk = disk
+	rs.Device = disk
+
+	if rs.RootPartition != "" {
+		sel, err := blkid.ParseSelector(rs.RootPartition)
+		if err != nil {
+			return err
+		}
+		part, err := blkid.FindPartition(disk, sel, blkid.PartitionTimeout)
+		if err != nil {
+			return errors.Wrap(err, "find root partition")
+		}
+		rs.Device = part.Device
+		rs.setFileSystem(part.Probe)
+		return nil
+	}
+
+	device, p, err := blkid.FindRoot(disk, blkid.PartitionTimeout)
+	if err != nil {
+		log.WarningLogMsg("Probe file system on %s failed: %v", disk, err)
+		return nil
+	}
+	if p == nil {
+		log.WarningLogMsg("No file system found on %s", disk)
+		return nil
+	}
+
+	rs.Device = device
+	rs.setFileSystem(p)
+	return nil
+}
+
+func (rs *BaseRootFS) setFileSystem(p *blkid.Probe) {
+	if p == nil {
+		log.WarningLogMsg("No file system found on %s", rs.Device)
+		return
+	}
+	log.DefaultLog("Found %s file system on %s, uuid: %s, label: %s", p.Type, rs.Device, p.UUID, p.Label)
+	rs.FileSystemType = p.Type
+	rs.FileSystemUUID = p.UUID
+	rs.FileSystemLabel = p.Label
 }
 
 func (rs *BaseRootFS) WriteOutput() error {
@@ -103,6 +218,9 @@ func (rs *BaseRootFS) WriteOutput() error {
 	o := RootFSOutput{
 		Device:         rs.Device,
 		FilesystemType: rs.FileSystemType,
+		UUID:           rs.FileSystemUUID,
+		Label:          rs.FileSystemLabel,
+		ReadOnly:       rs.ReadOnly || rs.publishReadOnly(),
 	}
 
 	b, err := json.Marshal(o)
@@ -0,0 +1,239 @@
+package diskimg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/QQGoblin/extrootfs/pkg/image"
+	"github.com/QQGoblin/extrootfs/pkg/image/oci"
+	"github.com/QQGoblin/extrootfs/pkg/image/treedigest"
+	"github.com/QQGoblin/extrootfs/pkg/utils/log"
+	"github.com/QQGoblin/extrootfs/pkg/utils/qemu"
+	"github.com/pkg/errors"
+	mount "k8s.io/mount-utils"
+)
+
+const (
+	FormatQcow2 = "qcow2"
+	FormatRaw   = "raw"
+
+	FileSystemExt4 = "ext4"
+	FileSystemXFS  = "xfs"
+)
+
+// Options 构建磁盘镜像的参数
+type Options struct {
+	// Input OCI layout 目录、OCI layout 归档或者 docker-archive 归档
+	Input string
+	// Ref 输入中包含多个镜像时用于选择镜像
+	Ref string
+	// Name 生成的镜像名称
+	Name string
+	// Size 磁盘镜像的大小（字节）
+	Size int64
+	// FileSystemType 磁盘镜像的文件系统类型，支持 ext4 和 xfs
+	FileSystemType string
+	// Format 磁盘镜像的格式，支持 qcow2 和 raw
+	Format string
+}
+
+func (o *Options) validate() error {
+
+	if err := image.ValidateName(o.Name); err != nil {
+		return err
+	}
+
+	if o.Size <= 0 {
+		return errors.New("size must be positive")
+	}
+
+	switch o.FileSystemType {
+	case FileSystemExt4, FileSystemXFS:
+	default:
+		return errors.Errorf("unsupported file system type %q", o.FileSystemType)
+	}
+
+	switch o.Format {
+	case FormatQcow2, FormatRaw:
+	default:
+		return errors.Errorf("unsupported image format %q", o.Format)
+	}
+
+	return nil
+}
+
+// Build 将 OCI 镜像的 layer 合并后写入新建的磁盘镜像，并注册到镜像目录。
+// 磁盘镜像通过 loop 设备挂载后写入，需要 root 权限。
+func Build(store *image.Store, opts Options) (*image.Manifest, error) {
+
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	if store.Exists(opts.Name) {
+		return nil, errors.Errorf("image %s already exists", opts.Name)
+	}
+
+	if err := os.MkdirAll(store.Dir(), 0755); err != nil {
+		return nil, err
+	}
+
+	img, err := oci.Load(opts.Input, opts.Ref)
+	if err != nil {
+		return nil, errors.Wrap(err, "load image")
+	}
+
+	temp := store.TempPath(opts.Name)
+	defer os.Remove(temp)
+
+	raw := temp + ".raw"
+	defer os.Remove(raw)
+
+	if err = createFileSystem(raw, opts.Size, opts.FileSystemType); err != nil {
+		return nil, errors.Wrap(err, "create file system")
+	}
+
+	contentDigest, err := populate(raw, img, temp+".content", temp+".mnt")
+	if err != nil {
+		return nil, errors.Wrap(err, "populate file system")
+	}
+
+	if opts.Format == FormatRaw {
+		err = os.Rename(raw, temp)
+	} else {
+		err = qemu.ConvertImage(temp, raw, opts.Format)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "convert image")
+	}
+
+	info, err := qemu.ImageInfo(temp)
+	if err != nil {
+		return nil, err
+	}
+
+	digest, err := image.FileDigest(temp)
+	if err != nil {
+		return nil, err
+	}
+
+	source := opts.Ref
+	if source == "" && len(img.RepoTags) > 0 {
+		source = img.RepoTags[0]
+	}
+
+	// 使用镜像配置的摘要（即镜像 ID）标识源镜像，OCI layout 和 docker-archive 的结果相同
+	configDigest := sha256.Sum256(img.Config)
+	manifest := &image.Manifest{
+		Name:           opts.Name,
+		Digest:         digest,
+		Format:         info.Format,
+		VirtualSize:    info.VirtualSize,
+		Source:         "oci:" + source,
+		CreatedAt:      time.Now(),
+		SourceDigest:   "sha256:" + hex.EncodeToString(configDigest[:]),
+		ContentDigest:  contentDigest,
+		FileSystemType: opts.FileSystemType,
+	}
+
+	if err = store.Register(temp, manifest); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+func createFileSystem(name string, size int64, fsType string) error {
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	var cmd *exec.Cmd
+	switch fsType {
+	case FileSystemExt4:
+		cmd = exec.Command("mkfs.ext4", "-F", "-q", name)
+	case FileSystemXFS:
+		cmd = exec.Command("mkfs.xfs", "-f", "-q", name)
+	}
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "mkfs.%s: %s", fsType, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// populate 通过 loop 设备挂载磁盘镜像，将合并后的 rootfs 解压到文件系统中，保留属主、权限、硬链接和扩展属性。
+// 解压后重新计算文件系统中的内容摘要，与镜像的内容摘要一致时返回该摘要。
+func populate(name string, img *oci.Image, contentDir, mountPoint string) (digest string, err error) {
+
+	rootfs, err := oci.Flatten(img, contentDir)
+	if err != nil {
+		return "", err
+	}
+	defer rootfs.Close()
+
+	if digest, err = treedigest.FromRootFS(rootfs); err != nil {
+		return "", err
+	}
+
+	if err = os.MkdirAll(mountPoint, 0755); err != nil {
+		return "", err
+	}
+	defer os.Remove(mountPoint)
+
+	mounter := mount.NewWithoutSystemd("")
+	if err = mounter.Mount(name, mountPoint, "", []string{"loop"}); err != nil {
+		return "", err
+	}
+	defer func() {
+		if umountErr := mounter.Unmount(mountPoint); umountErr != nil && err == nil {
+			err = umountErr
+		}
+	}()
+
+	log.DefaultLog("Populate %s from %d layers", name, len(img.Layers))
+	cmd := exec.Command("tar", "-x", "-p", "--numeric-owner", "--xattrs", "--xattrs-include=*", "-C", mountPoint, "-f", "-")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+	stderr := &strings.Builder{}
+	cmd.Stderr = stderr
+
+	if err = cmd.Start(); err != nil {
+		return "", err
+	}
+
+	writeErr := rootfs.WriteTar(stdin, "")
+	stdin.Close()
+	if err = cmd.Wait(); err != nil {
+		return "", errors.Wrapf(err, "extract rootfs: %s", strings.TrimSpace(stderr.String()))
+	}
+	if writeErr != nil {
+		return "", writeErr
+	}
+
+	written, err := treedigest.FromDir(mountPoint)
+	if err != nil {
+		return "", errors.Wrap(err, "digest file system")
+	}
+	if written != digest {
+		return "", errors.Errorf("content digest mismatch, expect %s, got %s", digest, written)
+	}
+
+	return digest, nil
+}
@@ -0,0 +1,196 @@
+package diskimg
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/QQGoblin/extrootfs/pkg/image"
+	"github.com/QQGoblin/extrootfs/pkg/image/oci"
+	"github.com/QQGoblin/extrootfs/pkg/image/treedigest"
+)
+
+const testTag = "rootfs:latest"
+
+// writeDockerArchive 在目录中生成只有一个 layer 的 docker-archive
+func writeDockerArchive(t *testing.T, dir string) {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	headers := []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0644, Size: 7},
+		{Typeflag: tar.TypeSymlink, Name: "etc/localtime", Linkname: "/usr/share/zoneinfo/UTC"},
+		{Typeflag: tar.TypeDir, Name: "root/", Mode: 0700, Uid: 0},
+		{Typeflag: tar.TypeReg, Name: "root/.profile", Mode: 0600, Uid: 1000, Gid: 1000, Size: 5},
+	}
+	contents := map[string]string{"etc/hostname": "rootfs\n", "root/.profile": "PS1=\n"}
+	for _, h := range headers {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(contents[h.Name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := json.Marshal([]map[string]interface{}{
+		{"Config": "config.json", "RepoTags": []string{testTag}, "Layers": []string{"layer.tar"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{
+		"manifest.json": manifest,
+		"config.json":   []byte(`{"architecture":"amd64","os":"linux"}`),
+		"layer.tar":     buf.Bytes(),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(path.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func requireCommands(t *testing.T, commands ...string) {
+	t.Helper()
+
+	if os.Geteuid() != 0 {
+		t.Skip("building disk images requires root")
+	}
+	for _, c := range commands {
+		if _, err := exec.LookPath(c); err != nil {
+			t.Skipf("%s is not installed", c)
+		}
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+
+	valid := Options{Name: "rootfs.qcow2", Size: 1 << 30, FileSystemType: FileSystemExt4, Format: FormatQcow2}
+
+	tests := []struct {
+		name   string
+		modify func(o *Options)
+		err    string
+	}{
+		{name: "valid", modify: func(o *Options) {}},
+		{name: "xfs raw", modify: func(o *Options) { o.FileSystemType, o.Format = FileSystemXFS, FormatRaw }},
+		{name: "invalid name", modify: func(o *Options) { o.Name = "../rootfs" }, err: "invalid"},
+		{name: "zero size", modify: func(o *Options) { o.Size = 0 }, err: "size must be positive"},
+		{name: "unsupported file system", modify: func(o *Options) { o.FileSystemType = "btrfs" }, err: "unsupported file system type"},
+		{name: "unsupported format", modify: func(o *Options) { o.Format = "vmdk" }, err: "unsupported image format"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := valid
+			tt.modify(&opts)
+			err := opts.validate()
+			if tt.err == "" && err != nil {
+				t.Fatalf("validate: %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("validate error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestBuildExistingImage(t *testing.T) {
+
+	store := image.NewStore(t.TempDir())
+	temp := store.TempPath("rootfs.qcow2")
+	if err := os.WriteFile(temp, []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Register(temp, &image.Manifest{Name: "rootfs.qcow2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := Options{Input: t.TempDir(), Name: "rootfs.qcow2", Size: 1 << 30, FileSystemType: FileSystemExt4, Format: FormatQcow2}
+	if _, err := Build(store, opts); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("Build error = %v, want already exists", err)
+	}
+}
+
+func TestPopulate(t *testing.T) {
+
+	requireCommands(t, "mkfs.ext4", "tar")
+
+	input := t.TempDir()
+	writeDockerArchive(t, input)
+	img, err := oci.Load(input, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 独立合并镜像计算期望的内容摘要
+	rootfs, err := oci.Flatten(img, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := treedigest.FromRootFS(rootfs)
+	rootfs.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	work := t.TempDir()
+	raw := path.Join(work, "rootfs.raw")
+	if err = createFileSystem(raw, 64<<20, FileSystemExt4); err != nil {
+		t.Fatalf("createFileSystem: %v", err)
+	}
+
+	digest, err := populate(raw, img, path.Join(work, "content"), path.Join(work, "mnt"))
+	if err != nil {
+		t.Fatalf("populate: %v", err)
+	}
+	if digest != want {
+		t.Errorf("populate digest = %s, want %s", digest, want)
+	}
+	if _, err = os.Stat(path.Join(work, "mnt")); !os.IsNotExist(err) {
+		t.Errorf("mount point is not removed: %v", err)
+	}
+}
+
+func TestBuild(t *testing.T) {
+
+	requireCommands(t, "mkfs.ext4", "tar", "qemu-img")
+
+	input := t.TempDir()
+	writeDockerArchive(t, input)
+	store := image.NewStore(t.TempDir())
+
+	manifest, err := Build(store, Options{Input: input, Name: "rootfs.qcow2", Size: 64 << 20, FileSystemType: FileSystemExt4, Format: FormatQcow2})
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+
+	want, err := treedigest.FromImage(input, "", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.ContentDigest != want {
+		t.Errorf("ContentDigest = %s, want %s", manifest.ContentDigest, want)
+	}
+	if manifest.Format != FormatQcow2 || manifest.VirtualSize != 64<<20 || manifest.FileSystemType != FileSystemExt4 {
+		t.Errorf("manifest = %+v", manifest)
+	}
+	if manifest.Source != "oci:"+testTag {
+		t.Errorf("Source = %s, want oci:%s", manifest.Source, testTag)
+	}
+	if !store.Exists("rootfs.qcow2") {
+		t.Error("image is not registered")
+	}
+}
@@ -0,0 +1,313 @@
+package extimg
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/QQGoblin/extrootfs/pkg/image/oci"
+	"github.com/QQGoblin/extrootfs/pkg/image/treedigest"
+	"github.com/pkg/errors"
+)
+
+const (
+	MetadataTar = "metadata.tar"
+	RootFSTar   = "rootfs.tar"
+	ConfigFile  = "config.json"
+	IDFile      = "sha256"
+
+	rootfsPrefix = "rootfs"
+	contentDir   = ".content"
+	metaSuffix   = "-meta"
+)
+
+// Options 构建 external image 的参数
+type Options struct {
+	// Input OCI layout 目录、OCI layout 归档或者 docker-archive 归档
+	Input string
+	// Ref 原始镜像名称，输入中包含多个镜像时用于选择镜像
+	Ref string
+	// MetaRef 生成的 metadata 镜像名称，默认为 <ref>-meta
+	MetaRef string
+	// MetaLayer metadata 镜像使用的 layer 文件，为空时使用内置的 layer
+	MetaLayer string
+	// Output 输出目录
+	Output string
+}
+
+// Config 是 external image 的描述文件 config.json
+type Config struct {
+	ID           string         `json:"id"`
+	Architecture string         `json:"architecture"`
+	OS           string         `json:"os"`
+	SHA256       string         `json:"sha256"`
+	Metadata     MetadataConfig `json:"metadata"`
+}
+
+type MetadataConfig struct {
+	SHA256 string `json:"sha256"`
+	Ref    string `json:"ref"`
+}
+
+// Build 将镜像转换为 external image：只包含镜像配置的 metadata 镜像、合并所有 layer 后的 rootfs.tar 以及 config.json。
+// 所有文件的时间戳和顺序都是固定的，相同的输入得到相同的输出。
+func Build(opts Options) (*Config, error) {
+
+	img, err := oci.Load(opts.Input, opts.Ref)
+	if err != nil {
+		return nil, errors.Wrap(err, "load image")
+	}
+
+	ref := opts.Ref
+	if ref == "" && len(img.RepoTags) > 0 {
+		ref = img.RepoTags[0]
+	}
+	metaRef := opts.MetaRef
+	if metaRef == "" {
+		if ref == "" {
+			return nil, errors.New("meta ref is required when the image has no name")
+		}
+		metaRef = ref + metaSuffix
+	}
+
+	if err = os.MkdirAll(opts.Output, 0755); err != nil {
+		return nil, err
+	}
+
+	metaLayer, err := loadMetaLayer(opts.MetaLayer)
+	if err != nil {
+		return nil, errors.Wrap(err, "load meta layer")
+	}
+
+	if err = writeMetaImage(filepath.Join(opts.Output, MetadataTar), img.Config, metaRef, metaLayer); err != nil {
+		return nil, errors.Wrap(err, "write metadata image")
+	}
+
+	rootfsSHA256, err := writeRootFS(filepath.Join(opts.Output, RootFSTar), img, filepath.Join(opts.Output, contentDir))
+	if err != nil {
+		return nil, errors.Wrap(err, "write rootfs")
+	}
+
+	metadataSHA256, err := fileDigest(filepath.Join(opts.Output, MetadataTar))
+	if err != nil {
+		return nil, errors.Wrap(err, "digest metadata image")
+	}
+
+	// 与 create-extimg.py 保持一致
+	id := sha256.Sum256([]byte(fmt.Sprintf("%%%s %s", metadataSHA256, rootfsSHA256)))
+	config := &Config{
+		ID:           hex.EncodeToString(id[:]),
+		Architecture: architecture(),
+		OS:           "linux",
+		SHA256:       rootfsSHA256,
+		Metadata: MetadataConfig{
+			SHA256: metadataSHA256,
+			Ref:    metaRef,
+		},
+	}
+
+	b, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(filepath.Join(opts.Output, ConfigFile), b, 0644); err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(filepath.Join(opts.Output, IDFile), []byte(config.ID), 0644); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// writeRootFS 写入合并后的 rootfs，返回 rootfs 的内容摘要
+func writeRootFS(name string, img *oci.Image, content string) (string, error) {
+
+	rootfs, err := oci.Flatten(img, content)
+	if err != nil {
+		return "", err
+	}
+	defer rootfs.Close()
+
+	digest, err := treedigest.FromRootFS(rootfs)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return "", err
+	}
+
+	err = rootfs.WriteTar(f, rootfsPrefix)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimPrefix(digest, "sha256:"), nil
+}
+
+func fileDigest(name string) (string, error) {
+
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// architecture 返回与 uname -m 一致的架构名称
+func architecture() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x86_64"
+	case "arm64":
+		return "aarch64"
+	}
+	return runtime.GOARCH
+}
+
+// writeMetaImage 生成 docker-archive 格式的 metadata 镜像，镜像配置与原始镜像相同，只包含一个 meta layer
+func writeMetaImage(name string, config []byte, ref string, layer []byte) error {
+
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(config, &fields); err != nil {
+		return errors.Wrap(err, "decode image config")
+	}
+
+	diffID := sha256.Sum256(layer)
+	rootfs, err := json.Marshal(map[string]interface{}{
+		"type":     "layers",
+		"diff_ids": []string{"sha256:" + hex.EncodeToString(diffID[:])},
+	})
+	if err != nil {
+		return err
+	}
+	fields["rootfs"] = rootfs
+
+	metaConfig, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	configID := sha256.Sum256(metaConfig)
+
+	layerFile := hex.EncodeToString(diffID[:]) + ".tar"
+	configFile := hex.EncodeToString(configID[:]) + ".json"
+	manifest, err := json.Marshal([]map[string]interface{}{{
+		"Config":   configFile,
+		"RepoTags": []string{ref},
+		"Layers":   []string{layerFile},
+	}})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{
+		{layerFile, layer},
+		{configFile, metaConfig},
+		{"manifest.json", manifest},
+	} {
+		if err = writeTarFile(tw, file.name, file.data); err != nil {
+			return err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// loadMetaLayer 读取 meta layer 并解压，docker-archive 中的 layer 保存为未压缩的 tar
+func loadMetaLayer(name string) ([]byte, error) {
+
+	if name == "" {
+		return defaultMetaLayer()
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, err := oci.Decompress(f)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// defaultMetaLayer 生成内置的 meta layer，只包含容器运行时常用的挂载点目录。
+// 容器的 rootfs 由 extrootfs 提供，meta layer 的内容不会被使用。
+func defaultMetaLayer() ([]byte, error) {
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, dir := range []string{"dev/", "etc/", "proc/", "sys/", "tmp/"} {
+		mode := int64(0755)
+		if dir == "tmp/" {
+			mode = 01777
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     dir,
+			Mode:     mode,
+			ModTime:  time.Unix(0, 0),
+			Format:   tar.FormatPAX,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(data)),
+		Mode:     0644,
+		ModTime:  time.Unix(0, 0),
+		Format:   tar.FormatPAX,
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
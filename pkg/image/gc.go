@@ -0,0 +1,217 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/QQGoblin/extrootfs/pkg/utils/log"
+	"github.com/pkg/errors"
+)
+
+// 刚被使用的镜像在磁盘空间不足时也不会被回收，避免删除即将用于创建 overlay 的镜像
+const recentlyUsedProtection = 10 * time.Minute
+
+// GCPolicy 镜像回收策略
+type GCPolicy struct {
+	// Interval 回收周期，为 0 时不回收镜像
+	Interval time.Duration
+	// MinAge 镜像最后一次被使用后经过 MinAge 才会被回收
+	MinAge time.Duration
+	// HighThresholdPercent 磁盘使用率超过该值时，不考虑 MinAge 按照最后使用时间回收镜像，直到低于 LowThresholdPercent
+	HighThresholdPercent int
+	LowThresholdPercent  int
+}
+
+// ReferenceFunc 返回所有仍被 overlay 或快照引用的镜像文件路径
+type ReferenceFunc func() (map[string]bool, error)
+
+type gcImage struct {
+	name     string
+	lastUsed time.Time
+}
+
+// MarkUsed 记录镜像的最后使用时间
+func (m *Manager) MarkUsed(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastUsed[name] = time.Now()
+}
+
+func (m *Manager) getLastUsed(name string) time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastUsed[name]
+}
+
+// RunGC 按照策略周期回收没有被引用的镜像，直到 stop 被关闭
+func (m *Manager) RunGC(policy GCPolicy, refs ReferenceFunc, stop <-chan struct{}) {
+
+	if policy.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(policy.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			removed, err := m.GarbageCollect(policy, refs)
+			if err != nil {
+				log.ErrorLogMsg("Image GC failed: %v", err)
+			}
+			if len(removed) > 0 {
+				log.DefaultLog("Image GC removed %v", removed)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// GarbageCollect 回收一次镜像，返回被删除的镜像名称。
+// 只回收从下载源拉取的镜像，手动放置、提交或者构建的镜像无法再次获取，被引用的镜像永远不会被删除。
+func (m *Manager) GarbageCollect(policy GCPolicy, refs ReferenceFunc) ([]string, error) {
+
+	references, err := refs()
+	if err != nil {
+		return nil, errors.Wrap(err, "image.GC")
+	}
+
+	images, err := m.unreferencedImages(references)
+	if err != nil {
+		return nil, errors.Wrap(err, "image.GC")
+	}
+
+	// 最早使用的镜像优先回收
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].lastUsed.Before(images[j].lastUsed)
+	})
+
+	var removed []string
+	remain := images[:0]
+	for _, img := range images {
+		if time.Since(img.lastUsed) < policy.MinAge {
+			remain = append(remain, img)
+			continue
+		}
+		if err = m.remove(img.name); err != nil {
+			return removed, errors.Wrap(err, "image.GC")
+		}
+		removed = append(removed, img.name)
+	}
+
+	if policy.HighThresholdPercent <= 0 {
+		return removed, nil
+	}
+
+	usage, err := diskUsagePercent(m.store.Dir())
+	if err != nil {
+		return removed, errors.Wrap(err, "image.GC")
+	}
+	if usage < policy.HighThresholdPercent {
+		return removed, nil
+	}
+
+	log.DefaultLog("Image disk usage %d%% exceeds %d%%, reclaim images", usage, policy.HighThresholdPercent)
+	for _, img := range remain {
+		if usage < policy.LowThresholdPercent {
+			break
+		}
+		if time.Since(img.lastUsed) < recentlyUsedProtection {
+			continue
+		}
+		if err = m.remove(img.name); err != nil {
+			return removed, errors.Wrap(err, "image.GC")
+		}
+		removed = append(removed, img.name)
+		if usage, err = diskUsagePercent(m.store.Dir()); err != nil {
+			return removed, errors.Wrap(err, "image.GC")
+		}
+	}
+
+	return removed, nil
+}
+
+func (m *Manager) unreferencedImages(references map[string]bool) ([]*gcImage, error) {
+
+	// 没有下载源时被回收的镜像无法再次拉取
+	if m.source == nil {
+		return nil, nil
+	}
+
+	entries, err := os.ReadDir(m.store.Dir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var images []*gcImage
+	for _, entry := range entries {
+		name := entry.Name()
+		// 跳过临时文件、元数据、签名以及目录
+		if entry.IsDir() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, manifestSuffix) || strings.HasSuffix(name, signatureSuffix) {
+			continue
+		}
+
+		p := m.store.Path(name)
+		if references[p] {
+			m.MarkUsed(name)
+			continue
+		}
+		if resolved, err := filepath.EvalSymlinks(p); err == nil && references[resolved] {
+			m.MarkUsed(name)
+			continue
+		}
+
+		manifest, err := m.store.LoadManifest(name)
+		if err != nil || !manifest.Pulled {
+			continue
+		}
+
+		lastUsed := manifest.CreatedAt
+		if t := m.getLastUsed(name); t.After(lastUsed) {
+			lastUsed = t
+		}
+
+		images = append(images, &gcImage{name: name, lastUsed: lastUsed})
+	}
+
+	return images, nil
+}
+
+func (m *Manager) remove(name string) error {
+
+	log.DefaultLog("Remove unused image %s", name)
+	if err := os.Remove(m.store.Path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(m.store.manifestPath(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(m.store.Path(name) + signatureSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	m.mu.Lock()
+	delete(m.lastUsed, name)
+	m.mu.Unlock()
+
+	return nil
+}
+
+func diskUsagePercent(dir string) (int, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	if st.Blocks == 0 {
+		return 0, nil
+	}
+	return int((st.Blocks - st.Bavail) * 100 / st.Blocks), nil
+}
@@ -0,0 +1,136 @@
+package image
+
+import (
+	"context"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+type fakeSource struct{}
+
+func (fakeSource) Open(ctx context.Context, name string) (io.ReadCloser, string, error) {
+	return nil, "", os.ErrNotExist
+}
+
+func (fakeSource) String() string {
+	return "fake://"
+}
+
+// addImage 在镜像目录中放置镜像，manifest 为空时模拟手动放置的镜像
+func addImage(t *testing.T, store *Store, name string, manifest *Manifest) {
+	t.Helper()
+
+	if manifest == nil {
+		if err := os.WriteFile(store.Path(name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// 手动放置的镜像修改时间很早
+		old := time.Now().Add(-48 * time.Hour)
+		if err := os.Chtimes(store.Path(name), old, old); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	temp := store.TempPath(name)
+	if err := os.WriteFile(temp, []byte(name), 0644); err != nil {
+		t.Fatal(err)
+	}
+	manifest.Name = name
+	if err := store.Register(temp, manifest); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGarbageCollect(t *testing.T) {
+
+	old := time.Now().Add(-48 * time.Hour)
+	policy := GCPolicy{Interval: time.Hour, MinAge: 24 * time.Hour}
+
+	tests := []struct {
+		name    string
+		source  Source
+		images  map[string]*Manifest
+		refs    []string
+		removed []string
+	}{
+		{
+			name:   "only pulled images are collected",
+			source: fakeSource{},
+			images: map[string]*Manifest{
+				"pulled.qcow2":    {CreatedAt: old, Pulled: true},
+				"manual.qcow2":    nil,
+				"committed.qcow2": {CreatedAt: old, Source: "rootfs:pvc-1"},
+				"built.qcow2":     {CreatedAt: old, Source: "oci:busybox"},
+			},
+			removed: []string{"pulled.qcow2"},
+		},
+		{
+			name:   "referenced and recent images are kept",
+			source: fakeSource{},
+			images: map[string]*Manifest{
+				"referenced.qcow2": {CreatedAt: old, Pulled: true},
+				"recent.qcow2":     {CreatedAt: time.Now(), Pulled: true},
+				"unused.qcow2":     {CreatedAt: old, Pulled: true},
+			},
+			refs:    []string{"referenced.qcow2"},
+			removed: []string{"unused.qcow2"},
+		},
+		{
+			name: "nothing is collected without a source",
+			images: map[string]*Manifest{
+				"pulled.qcow2": {CreatedAt: old, Pulled: true},
+				"manual.qcow2": nil,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			store := NewStore(t.TempDir())
+			for name, manifest := range tt.images {
+				addImage(t, store, name, manifest)
+			}
+
+			verifier, err := NewVerifier("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := NewManager(store, tt.source, verifier)
+
+			refs := func() (map[string]bool, error) {
+				references := make(map[string]bool)
+				for _, name := range tt.refs {
+					references[store.Path(name)] = true
+				}
+				return references, nil
+			}
+
+			removed, err := m.GarbageCollect(policy, refs)
+			if err != nil {
+				t.Fatalf("GarbageCollect: %v", err)
+			}
+			sort.Strings(removed)
+			if !reflect.DeepEqual(removed, tt.removed) {
+				t.Errorf("removed %q, want %q", removed, tt.removed)
+			}
+
+			for name := range tt.images {
+				want := true
+				for _, r := range tt.removed {
+					if r == name {
+						want = false
+					}
+				}
+				if store.Exists(name) != want {
+					t.Errorf("image %s exists %t, want %t", name, store.Exists(name), want)
+				}
+			}
+		})
+	}
+}
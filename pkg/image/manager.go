@@ -0,0 +1,226 @@
+package image
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/QQGoblin/extrootfs/pkg/utils/log"
+	"github.com/QQGoblin/extrootfs/pkg/utils/qemu"
+	"github.com/pkg/errors"
+)
+
+// pullTimeout 单个镜像下载的最长时间，避免下载源没有响应时下载一直无法结束
+const pullTimeout = time.Hour
+
+// Manager 负责在镜像缺失时从下载源拉取基础镜像，相同镜像的并发请求只会触发一次下载
+type Manager struct {
+	store    *Store
+	source   Source
+	verifier *Verifier
+
+	mu       sync.Mutex
+	pulls    map[string]*pull
+	lastUsed map[string]time.Time
+}
+
+type pull struct {
+	done chan struct{}
+	err  error
+}
+
+// NewManager 创建镜像管理器，source 为空时只使用本地已有的镜像
+func NewManager(store *Store, source Source, verifier *Verifier) *Manager {
+	return &Manager{
+		store:    store,
+		source:   source,
+		verifier: verifier,
+		pulls:    make(map[string]*pull),
+		lastUsed: make(map[string]time.Time),
+	}
+}
+
+func (m *Manager) Store() *Store {
+	return m.store
+}
+
+// Ensure 保证镜像存在于本地镜像目录中，返回镜像文件路径。
+// 下载使用调用方 ctx 中的值但不随调用方取消，调用方超时返回后下载仍会继续，重试时等待同一个下载完成，
+// 下载最长持续 pullTimeout。
+func (m *Manager) Ensure(ctx context.Context, name string) (string, error) {
+
+	if err := ValidateName(name); err != nil {
+		return "", err
+	}
+
+	m.MarkUsed(name)
+
+	if m.store.Exists(name) {
+		return m.store.Path(name), nil
+	}
+
+	if m.source == nil {
+		return "", fmt.Errorf("image %s not found in %s and no image source configured", name, m.store.Dir())
+	}
+
+	p := m.startPull(ctx, name)
+
+	select {
+	case <-p.done:
+		if p.err != nil {
+			return "", p.err
+		}
+		return m.store.Path(name), nil
+	case <-ctx.Done():
+		return "", errors.Wrapf(ctx.Err(), "waiting for image %s", name)
+	}
+}
+
+// Verify 校验本地镜像的摘要以及签名，expectedDigest 为空时只在配置了公钥时校验签名
+func (m *Manager) Verify(name, expectedDigest string) error {
+	return m.verifier.Verify(m.store.Path(name), expectedDigest)
+}
+
+func (m *Manager) startPull(ctx context.Context, name string) *pull {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if p, ok := m.pulls[name]; ok {
+		return p
+	}
+
+	p := &pull{done: make(chan struct{})}
+	m.pulls[name] = p
+
+	go func() {
+		ctx, cancel := context.WithTimeout(detachedContext{ctx}, pullTimeout)
+		defer cancel()
+		p.err = m.pull(ctx, name)
+		m.mu.Lock()
+		delete(m.pulls, name)
+		m.mu.Unlock()
+		close(p.done)
+	}()
+
+	return p
+}
+
+func (m *Manager) pull(ctx context.Context, name string) error {
+
+	// 等待锁期间其他请求可能已经完成下载
+	if m.store.Exists(name) {
+		return nil
+	}
+
+	if err := os.MkdirAll(m.store.Dir(), 0755); err != nil {
+		return errors.Wrap(err, "image.Pull")
+	}
+
+	log.DefaultLog("Pull image %s from %s", name, m.source)
+	start := time.Now()
+
+	body, digest, err := m.source.Open(ctx, name)
+	if err != nil {
+		return errors.Wrapf(err, "pull image %s", name)
+	}
+	defer body.Close()
+
+	temp := m.store.TempPath(name)
+	defer os.Remove(temp)
+
+	f, err := os.OpenFile(temp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "pull image %s", name)
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), body)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "pull image %s", name)
+	}
+
+	if actual := digestPrefix + hex.EncodeToString(h.Sum(nil)); actual != digest {
+		return fmt.Errorf("pull image %s: digest mismatch, expected %s, got %s", name, digest, actual)
+	}
+
+	info, err := qemu.ImageInfo(temp)
+	if err != nil {
+		return errors.Wrapf(err, "pull image %s", name)
+	}
+
+	manifest := &Manifest{
+		Name:        name,
+		Digest:      digest,
+		Format:      info.Format,
+		VirtualSize: info.VirtualSize,
+		Source:      m.source.String(),
+		CreatedAt:   time.Now(),
+		Pulled:      true,
+	}
+
+	if err = m.pullSignature(ctx, name); err != nil {
+		return errors.Wrapf(err, "pull image %s", name)
+	}
+
+	if err = m.store.Register(temp, manifest); err != nil {
+		return errors.Wrapf(err, "pull image %s", name)
+	}
+
+	log.DefaultLog("Pull image %s success, digest %s, cost %v", name, digest, time.Since(start))
+	return nil
+}
+
+// pullSignature 配置了公钥时从下载源获取镜像签名
+func (m *Manager) pullSignature(ctx context.Context, name string) error {
+
+	if !m.verifier.SignatureRequired() {
+		return nil
+	}
+
+	source, ok := m.source.(signatureSource)
+	if !ok {
+		return fmt.Errorf("image source %s does not provide signatures", m.source)
+	}
+
+	body, err := source.OpenSignature(ctx, name)
+	if err != nil {
+		return errors.Wrap(err, "pull signature")
+	}
+	defer body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(body, 64*1024))
+	if err != nil {
+		return errors.Wrap(err, "pull signature")
+	}
+
+	return writeFileAtomic(m.store.Path(name)+signatureSuffix, b, 0644)
+}
+
+// detachedContext 保留调用方 ctx 中的值，但不继承调用方的取消和超时
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
@@ -0,0 +1,284 @@
+package oci
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ociIndexFile    = "index.json"
+	dockerManifest  = "manifest.json"
+	refAnnotation   = "org.opencontainers.image.ref.name"
+	mediaTypeIndex  = "application/vnd.oci.image.index.v1+json"
+	mediaTypeDocker = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// Image 是从 OCI layout 或者 docker-archive 中读取的镜像
+type Image struct {
+	// Config 镜像配置的原始内容
+	Config []byte
+	// Layers 按照从下到上的顺序排列
+	Layers []*Layer
+	// RepoTags docker-archive 中记录的镜像名称
+	RepoTags []string
+
+	files fileSource
+}
+
+// Layer 是镜像中的一层，Name 为 layer 在输入中的路径
+type Layer struct {
+	Name  string
+	files fileSource
+}
+
+// Open 返回 layer 的原始内容（可能是压缩后的）
+func (l *Layer) Open() (io.ReadCloser, error) {
+	return l.files.Open(l.Name)
+}
+
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform,omitempty"`
+}
+
+type index struct {
+	Manifests []descriptor `json:"manifests"`
+}
+
+type manifest struct {
+	Config descriptor   `json:"config"`
+	Layers []descriptor `json:"layers"`
+}
+
+type dockerArchiveManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// Load 读取 OCI layout 目录、OCI layout 归档或者 docker-archive 归档，ref 用于在包含多个镜像时选择镜像
+func Load(input, ref string) (*Image, error) {
+
+	fi, err := os.Stat(input)
+	if err != nil {
+		return nil, err
+	}
+
+	var files fileSource
+	if fi.IsDir() {
+		files = dirSource(input)
+	} else {
+		files = tarSource(input)
+	}
+
+	if files.Exists(ociIndexFile) {
+		return loadOCI(files, ref)
+	}
+	if files.Exists(dockerManifest) {
+		return loadDockerArchive(files, ref)
+	}
+
+	return nil, fmt.Errorf("%s is neither an OCI layout nor a docker-archive", input)
+}
+
+func loadOCI(files fileSource, ref string) (*Image, error) {
+
+	idx := &index{}
+	if err := readJSON(files, ociIndexFile, idx); err != nil {
+		return nil, err
+	}
+
+	var selected []descriptor
+	for _, m := range idx.Manifests {
+		name := m.Annotations[refAnnotation]
+		if ref == "" || name == ref || strings.HasSuffix(ref, ":"+name) {
+			selected = append(selected, m)
+		}
+	}
+	if len(selected) != 1 {
+		return nil, fmt.Errorf("found %d images matching %q in OCI layout", len(selected), ref)
+	}
+
+	desc := selected[0]
+	// 多架构镜像选择当前平台
+	if desc.MediaType == mediaTypeIndex || desc.MediaType == mediaTypeDocker {
+		sub := &index{}
+		if err := readJSON(files, blobPath(desc.Digest), sub); err != nil {
+			return nil, err
+		}
+		found := false
+		for _, m := range sub.Manifests {
+			if m.Platform != nil && m.Platform.OS == "linux" && m.Platform.Architecture == runtime.GOARCH {
+				desc, found = m, true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no linux/%s image in index %s", runtime.GOARCH, desc.Digest)
+		}
+	}
+
+	m := &manifest{}
+	if err := readJSON(files, blobPath(desc.Digest), m); err != nil {
+		return nil, err
+	}
+
+	config, err := readAll(files, blobPath(m.Config.Digest))
+	if err != nil {
+		return nil, err
+	}
+
+	img := &Image{Config: config, files: files}
+	for _, l := range m.Layers {
+		img.Layers = append(img.Layers, &Layer{Name: blobPath(l.Digest), files: files})
+	}
+
+	return img, nil
+}
+
+func loadDockerArchive(files fileSource, ref string) (*Image, error) {
+
+	var manifests []dockerArchiveManifest
+	if err := readJSON(files, dockerManifest, &manifests); err != nil {
+		return nil, err
+	}
+
+	var selected []dockerArchiveManifest
+	for _, m := range manifests {
+		if ref == "" {
+			selected = append(selected, m)
+			continue
+		}
+		for _, tag := range m.RepoTags {
+			if tag == ref {
+				selected = append(selected, m)
+				break
+			}
+		}
+	}
+	if len(selected) != 1 {
+		return nil, fmt.Errorf("found %d images matching %q in docker-archive", len(selected), ref)
+	}
+
+	m := selected[0]
+	config, err := readAll(files, m.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &Image{Config: config, RepoTags: m.RepoTags, files: files}
+	for _, l := range m.Layers {
+		img.Layers = append(img.Layers, &Layer{Name: l, files: files})
+	}
+
+	return img, nil
+}
+
+func blobPath(digest string) string {
+	return path.Join("blobs", strings.Replace(digest, ":", "/", 1))
+}
+
+func readAll(files fileSource, name string) ([]byte, error) {
+	r, err := files.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func readJSON(files fileSource, name string, v interface{}) error {
+	b, err := readAll(files, name)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(b, v); err != nil {
+		return errors.Wrapf(err, "decode %s", name)
+	}
+	return nil
+}
+
+// fileSource 以相同的方式访问目录和 tar 归档中的文件
+type fileSource interface {
+	Open(name string) (io.ReadCloser, error)
+	Exists(name string) bool
+}
+
+type dirSource string
+
+func (d dirSource) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(d), filepath.FromSlash(name)))
+}
+
+func (d dirSource) Exists(name string) bool {
+	_, err := os.Stat(filepath.Join(string(d), filepath.FromSlash(name)))
+	return err == nil
+}
+
+// tarSource 每次打开文件时顺序扫描归档，避免将整个归档解压到磁盘
+type tarSource string
+
+type tarFile struct {
+	io.Reader
+	f *os.File
+}
+
+func (t *tarFile) Close() error {
+	return t.f.Close()
+}
+
+func (t tarSource) Open(name string) (io.ReadCloser, error) {
+
+	f, err := os.Open(string(t))
+	if err != nil {
+		return nil, err
+	}
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, errors.Wrapf(err, "read %s", t)
+		}
+		if cleanName(hdr.Name) == name && hdr.FileInfo().Mode().IsRegular() {
+			return &tarFile{Reader: tr, f: f}, nil
+		}
+	}
+
+	f.Close()
+	return nil, errors.Wrapf(os.ErrNotExist, "%s in %s", name, t)
+}
+
+func (t tarSource) Exists(name string) bool {
+	r, err := t.Open(name)
+	if err != nil {
+		return false
+	}
+	r.Close()
+	return true
+}
+
+// cleanName 将归档中的路径统一为不带前缀 ./ 和 / 的相对路径，根目录返回空字符串
+func cleanName(name string) string {
+	name = path.Clean("/" + name)
+	return strings.TrimPrefix(name, "/")
+}
@@ -0,0 +1,56 @@
+package oci
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+type layerReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *layerReader) Close() error {
+	var err error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if e := r.closers[i].Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Decompress 根据内容识别压缩格式，返回 layer 的 tar 流
+func Decompress(r io.ReadCloser) (io.ReadCloser, error) {
+
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		r.Close()
+		return nil, errors.Wrap(err, "detect layer compression")
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			r.Close()
+			return nil, errors.Wrap(err, "open gzip layer")
+		}
+		return &layerReader{Reader: gz, closers: []io.Closer{r, gz}}, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		r.Close()
+		return nil, errors.New("zstd compressed layers are not supported")
+	}
+
+	return &layerReader{Reader: br, closers: []io.Closer{r}}, nil
+}
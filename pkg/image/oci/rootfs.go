@@ -0,0 +1,359 @@
+package oci
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+	xattrPAXPrefix = "SCHILY.xattr."
+)
+
+// Entry 是合并后的 rootfs 中的一个文件
+type Entry struct {
+	// Header 中的 Name 为不带前缀的相对路径，硬链接已经被展开为普通文件
+	Header *tar.Header
+	// Digest 普通文件内容的 sha256
+	Digest string
+
+	content string
+	inode   int
+}
+
+// RootFS 在用户态按照 overlay 的语义合并镜像的各个 layer，不需要 root 权限和 overlay 挂载。
+// 文件元数据保存在内存中，普通文件的内容按照 sha256 去重保存在 contentDir 中。
+type RootFS struct {
+	entries    map[string]*Entry
+	contentDir string
+	nextInode  int
+}
+
+// Flatten 依次应用镜像的所有 layer，contentDir 在 Close 时被删除
+func Flatten(img *Image, contentDir string) (*RootFS, error) {
+
+	if err := os.MkdirAll(contentDir, 0700); err != nil {
+		return nil, err
+	}
+
+	rootfs := &RootFS{entries: make(map[string]*Entry), contentDir: contentDir}
+	for _, layer := range img.Layers {
+		if err := rootfs.applyLayer(layer); err != nil {
+			rootfs.Close()
+			return nil, err
+		}
+	}
+
+	return rootfs, nil
+}
+
+// Close 删除保存文件内容的临时目录
+func (r *RootFS) Close() error {
+	return os.RemoveAll(r.contentDir)
+}
+
+func (r *RootFS) applyLayer(layer *Layer) error {
+
+	raw, err := layer.Open()
+	if err != nil {
+		return errors.Wrapf(err, "open layer %s", layer.Name)
+	}
+
+	rc, err := Decompress(raw)
+	if err != nil {
+		return errors.Wrapf(err, "open layer %s", layer.Name)
+	}
+	defer rc.Close()
+
+	if err = r.Apply(rc); err != nil {
+		return errors.Wrapf(err, "apply layer %s", layer.Name)
+	}
+
+	return nil
+}
+
+// Apply 将一个 layer 的 tar 流合并到 rootfs 中，处理 whiteout 和 opaque 目录
+func (r *RootFS) Apply(layer io.Reader) error {
+
+	added := make(map[string]bool)
+	tr := tar.NewReader(layer)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := cleanName(hdr.Name)
+		if name == "" {
+			continue
+		}
+
+		dir, base := parentOf(name), path.Base(name)
+		switch {
+		case base == whiteoutOpaque:
+			r.removeChildren(dir, added)
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			r.remove(path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+			continue
+		}
+
+		r.ensureParents(name)
+
+		// 目录被其他类型的文件覆盖时，目录下的内容一起被覆盖
+		if existing, ok := r.entries[name]; ok && existing.Header.Typeflag == tar.TypeDir && hdr.Typeflag != tar.TypeDir {
+			r.remove(name)
+		}
+
+		entry, err := r.newEntry(name, hdr, tr)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			continue
+		}
+
+		r.entries[name] = entry
+		added[name] = true
+	}
+}
+
+func (r *RootFS) newEntry(name string, hdr *tar.Header, tr io.Reader) (*Entry, error) {
+
+	h := normalizeHeader(name, hdr)
+
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		h.Typeflag = tar.TypeReg
+		digest, content, err := r.storeContent(tr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "store %s", name)
+		}
+		r.nextInode++
+		return &Entry{Header: h, Digest: digest, content: content, inode: r.nextInode}, nil
+	case tar.TypeLink:
+		target, ok := r.entries[cleanName(hdr.Linkname)]
+		if !ok || target.Header.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("hardlink %s to missing file %s", name, hdr.Linkname)
+		}
+		// 硬链接与目标共享 inode，元数据以目标为准
+		h = normalizeHeader(name, target.Header)
+		return &Entry{Header: h, Digest: target.Digest, content: target.content, inode: target.inode}, nil
+	case tar.TypeDir, tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		h.Size = 0
+		return &Entry{Header: h}, nil
+	}
+
+	// 其他类型（如 PAX 全局头）不属于文件系统内容
+	return nil, nil
+}
+
+// normalizeHeader 只保留文件系统相关的元数据，保证输出可以复现
+func normalizeHeader(name string, hdr *tar.Header) *tar.Header {
+
+	h := &tar.Header{
+		Typeflag: hdr.Typeflag,
+		Name:     name,
+		Linkname: hdr.Linkname,
+		Size:     hdr.Size,
+		Mode:     hdr.Mode,
+		Uid:      hdr.Uid,
+		Gid:      hdr.Gid,
+		Uname:    hdr.Uname,
+		Gname:    hdr.Gname,
+		ModTime:  hdr.ModTime,
+		Devmajor: hdr.Devmajor,
+		Devminor: hdr.Devminor,
+		Format:   tar.FormatPAX,
+	}
+
+	for k, v := range hdr.PAXRecords {
+		if strings.HasPrefix(k, xattrPAXPrefix) {
+			if h.PAXRecords == nil {
+				h.PAXRecords = make(map[string]string)
+			}
+			h.PAXRecords[k] = v
+		}
+	}
+
+	return h
+}
+
+func (r *RootFS) storeContent(src io.Reader) (string, string, error) {
+
+	f, err := os.CreateTemp(r.contentDir, ".tmp-")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(f.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), src)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	content := filepath.Join(r.contentDir, sum)
+	if _, err = os.Stat(content); os.IsNotExist(err) {
+		err = os.Rename(f.Name(), content)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	return "sha256:" + sum, content, nil
+}
+
+func (r *RootFS) ensureParents(name string) {
+	for dir := parentOf(name); dir != ""; dir = parentOf(dir) {
+		if _, ok := r.entries[dir]; ok {
+			return
+		}
+		r.entries[dir] = &Entry{Header: &tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     dir,
+			Mode:     0755,
+			ModTime:  time.Unix(0, 0),
+			Format:   tar.FormatPAX,
+		}}
+	}
+}
+
+// remove 删除文件，如果是目录则删除整个目录
+func (r *RootFS) remove(name string) {
+	delete(r.entries, name)
+	prefix := name + "/"
+	for k := range r.entries {
+		if strings.HasPrefix(k, prefix) {
+			delete(r.entries, k)
+		}
+	}
+}
+
+// removeChildren 删除目录下来自下层 layer 的内容，保留当前 layer 中新增的文件
+func (r *RootFS) removeChildren(dir string, added map[string]bool) {
+	prefix := dir + "/"
+	for k := range r.entries {
+		if (dir == "" || strings.HasPrefix(k, prefix)) && !added[k] {
+			delete(r.entries, k)
+		}
+	}
+}
+
+// Names 返回按照路径排序的所有文件
+func (r *RootFS) Names() []string {
+	names := make([]string, 0, len(r.entries))
+	for name := range r.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get 返回文件
+func (r *RootFS) Get(name string) *Entry {
+	return r.entries[name]
+}
+
+// Open 返回普通文件的内容
+func (r *RootFS) Open(e *Entry) (io.ReadCloser, error) {
+	if e.content == "" {
+		return nil, fmt.Errorf("%s is not a regular file", e.Header.Name)
+	}
+	return os.Open(e.content)
+}
+
+// WriteTar 将 rootfs 按照路径顺序写入 tar，所有路径添加 prefix 目录前缀。
+// 共享 inode 的文件中排序最靠前的写为普通文件，其余写为指向它的硬链接。
+func (r *RootFS) WriteTar(w io.Writer, prefix string) error {
+
+	tw := tar.NewWriter(w)
+
+	if prefix != "" {
+		prefix = strings.Trim(prefix, "/") + "/"
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     prefix,
+			Mode:     0755,
+			ModTime:  time.Unix(0, 0),
+			Format:   tar.FormatPAX,
+		}); err != nil {
+			return err
+		}
+	}
+
+	linked := make(map[int]string)
+	for _, name := range r.Names() {
+		e := r.entries[name]
+		h := *e.Header
+		h.Name = prefix + name
+		if h.Typeflag == tar.TypeDir {
+			h.Name += "/"
+		}
+
+		if h.Typeflag != tar.TypeReg {
+			if err := tw.WriteHeader(&h); err != nil {
+				return errors.Wrapf(err, "write %s", name)
+			}
+			continue
+		}
+
+		if first, ok := linked[e.inode]; ok {
+			h.Typeflag = tar.TypeLink
+			h.Linkname = first
+			h.Size = 0
+			if err := tw.WriteHeader(&h); err != nil {
+				return errors.Wrapf(err, "write %s", name)
+			}
+			continue
+		}
+		linked[e.inode] = h.Name
+
+		if err := tw.WriteHeader(&h); err != nil {
+			return errors.Wrapf(err, "write %s", name)
+		}
+		if err := r.copyContent(tw, e); err != nil {
+			return errors.Wrapf(err, "write %s", name)
+		}
+	}
+
+	return tw.Close()
+}
+
+func (r *RootFS) copyContent(w io.Writer, e *Entry) error {
+	f, err := r.Open(e)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func parentOf(name string) string {
+	dir := path.Dir(name)
+	if dir == "." || dir == "/" {
+		return ""
+	}
+	return dir
+}
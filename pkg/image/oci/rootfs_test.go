@@ -0,0 +1,197 @@
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// testEntry 是 layer 中的一个文件，typ 为 tar 的类型，content 为普通文件内容或者硬链接目标
+type testEntry struct {
+	typ     byte
+	name    string
+	content string
+}
+
+func dir(name string) testEntry {
+	return testEntry{typ: tar.TypeDir, name: name}
+}
+
+func file(name, content string) testEntry {
+	return testEntry{typ: tar.TypeReg, name: name, content: content}
+}
+
+func link(name, target string) testEntry {
+	return testEntry{typ: tar.TypeLink, name: name, content: target}
+}
+
+func buildLayer(t *testing.T, entries []testEntry) io.Reader {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		h := &tar.Header{Typeflag: e.typ, Name: e.name, Mode: 0644}
+		switch e.typ {
+		case tar.TypeDir:
+			h.Mode = 0755
+		case tar.TypeReg:
+			h.Size = int64(len(e.content))
+		case tar.TypeLink:
+			h.Linkname = e.content
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf("write header %s: %v", e.name, err)
+		}
+		if e.typ == tar.TypeReg {
+			if _, err := tw.Write([]byte(e.content)); err != nil {
+				t.Fatalf("write %s: %v", e.name, err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close layer: %v", err)
+	}
+
+	return buf
+}
+
+// readTar 将 tar 中的文件表示为 "<type> <name> [content|linkname]"
+func readTar(t *testing.T, r io.Reader) []string {
+	t.Helper()
+
+	var files []string
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatalf("read tar: %v", err)
+		}
+		switch h.Typeflag {
+		case tar.TypeDir:
+			files = append(files, "dir "+h.Name)
+		case tar.TypeReg:
+			b, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatalf("read %s: %v", h.Name, err)
+			}
+			files = append(files, fmt.Sprintf("file %s %s", h.Name, b))
+		case tar.TypeLink:
+			files = append(files, fmt.Sprintf("link %s %s", h.Name, h.Linkname))
+		default:
+			files = append(files, fmt.Sprintf("%c %s", h.Typeflag, h.Name))
+		}
+	}
+}
+
+func TestRootFSApply(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		layers [][]testEntry
+		prefix string
+		names  []string
+		tar    []string
+	}{
+		{
+			name: "whiteout",
+			layers: [][]testEntry{
+				{dir("etc/"), file("etc/a", "a"), file("etc/b", "b"), dir("etc/d/"), file("etc/d/c", "c")},
+				{file("etc/.wh.a", ""), file("etc/.wh.d", "")},
+			},
+			names: []string{"etc", "etc/b"},
+			tar:   []string{"dir etc/", "file etc/b b"},
+		},
+		{
+			name: "opaque directory",
+			layers: [][]testEntry{
+				{dir("d/"), file("d/old", "old"), dir("d/sub/"), file("d/sub/x", "x"), file("keep", "keep")},
+				{dir("d/"), file("d/.wh..wh..opq", ""), file("d/new", "new")},
+			},
+			names: []string{"d", "d/new", "keep"},
+			tar:   []string{"dir d/", "file d/new new", "file keep keep"},
+		},
+		{
+			name: "opaque marker after new files",
+			layers: [][]testEntry{
+				{dir("d/"), file("d/old", "old")},
+				{file("d/new", "new"), file("d/.wh..wh..opq", "")},
+			},
+			names: []string{"d", "d/new"},
+			tar:   []string{"dir d/", "file d/new new"},
+		},
+		{
+			name: "directory replaced by file",
+			layers: [][]testEntry{
+				{dir("d/"), file("d/x", "x"), dir("d/sub/"), file("d/sub/y", "y")},
+				{file("d", "file")},
+			},
+			names: []string{"d"},
+			tar:   []string{"file d file"},
+		},
+		{
+			name: "hardlink",
+			layers: [][]testEntry{
+				{file("a", "data"), link("b", "a")},
+			},
+			prefix: "rootfs",
+			names:  []string{"a", "b"},
+			tar:    []string{"dir rootfs/", "file rootfs/a data", "link rootfs/b rootfs/a"},
+		},
+		{
+			name: "hardlink sorted before its target",
+			layers: [][]testEntry{
+				{dir("bin/"), file("bin/z", "data"), link("bin/a", "bin/z")},
+			},
+			names: []string{"bin", "bin/a", "bin/z"},
+			tar:   []string{"dir bin/", "file bin/a data", "link bin/z bin/a"},
+		},
+		{
+			name: "hardlink target replaced in upper layer",
+			layers: [][]testEntry{
+				{file("a", "old"), link("b", "a")},
+				{file("a", "new")},
+			},
+			names: []string{"a", "b"},
+			tar:   []string{"file a new", "file b old"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			r := &RootFS{entries: make(map[string]*Entry), contentDir: t.TempDir()}
+			for i, layer := range tt.layers {
+				if err := r.Apply(buildLayer(t, layer)); err != nil {
+					t.Fatalf("apply layer %d: %v", i, err)
+				}
+			}
+
+			if names := r.Names(); !reflect.DeepEqual(names, tt.names) {
+				t.Errorf("Names() = %q, want %q", names, tt.names)
+			}
+
+			buf := &bytes.Buffer{}
+			if err := r.WriteTar(buf, tt.prefix); err != nil {
+				t.Fatalf("WriteTar: %v", err)
+			}
+			if files := readTar(t, buf); !reflect.DeepEqual(files, tt.tar) {
+				t.Errorf("WriteTar() = %q, want %q", files, tt.tar)
+			}
+		})
+	}
+}
+
+func TestRootFSApplyMissingHardlink(t *testing.T) {
+
+	r := &RootFS{entries: make(map[string]*Entry), contentDir: t.TempDir()}
+	if err := r.Apply(buildLayer(t, []testEntry{link("b", "a")})); err == nil {
+		t.Fatal("Apply hardlink to missing file succeeded, want error")
+	}
+}
@@ -0,0 +1,226 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/QQGoblin/extrootfs/pkg/utils/log"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// PrepullConfigKey ConfigMap 中保存预拉取镜像列表的 key
+	PrepullConfigKey = "images"
+	// PrepullStatusAnnotation 节点上记录预拉取状态的注解
+	PrepullStatusAnnotation = "extrootfs.io/prepull-status"
+
+	PrepullStatePulling = "Pulling"
+	PrepullStateReady   = "Ready"
+	PrepullStateFailed  = "Failed"
+
+	// 定期重新检查节点标签以及重试失败的镜像
+	prepullResync = 5 * time.Minute
+)
+
+// PrepullImage 描述需要预拉取到节点上的镜像，NodeSelector 为空时拉取到所有节点
+type PrepullImage struct {
+	Name         string            `json:"name"`
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+}
+
+// PrepullStatus 节点上单个镜像的预拉取状态
+type PrepullStatus struct {
+	State   string `json:"state"`
+	Digest  string `json:"digest,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Prepuller 监听 ConfigMap 中的镜像列表，在后台将匹配当前节点的镜像拉取到本地，
+// 并将每个镜像的状态以 JSON 的形式记录在节点的 extrootfs.io/prepull-status 注解中。
+type Prepuller struct {
+	client    kubernetes.Interface
+	manager   *Manager
+	nodeName  string
+	namespace string
+	name      string
+
+	mu     sync.Mutex
+	status map[string]*PrepullStatus
+}
+
+func NewPrepuller(client kubernetes.Interface, manager *Manager, nodeName, namespace, name string) *Prepuller {
+	return &Prepuller{
+		client:    client,
+		manager:   manager,
+		nodeName:  nodeName,
+		namespace: namespace,
+		name:      name,
+		status:    make(map[string]*PrepullStatus),
+	}
+}
+
+// Run 监听 ConfigMap 的变化，直到 stop 被关闭
+func (p *Prepuller) Run(stop <-chan struct{}) {
+
+	factory := informers.NewSharedInformerFactoryWithOptions(p.client, prepullResync,
+		informers.WithNamespace(p.namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", p.name).String()
+		}),
+	)
+
+	informer := factory.Core().V1().ConfigMaps().Informer()
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			p.sync(obj.(*corev1.ConfigMap))
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			p.sync(obj.(*corev1.ConfigMap))
+		},
+		DeleteFunc: func(obj interface{}) {
+			p.sync(nil)
+		},
+	})
+	if err != nil {
+		log.ErrorLogMsg("Failed to watch prepull config %s/%s: %v", p.namespace, p.name, err)
+		return
+	}
+
+	log.DefaultLog("Watching prepull config %s/%s", p.namespace, p.name)
+	factory.Start(stop)
+	<-stop
+}
+
+// Wanted 返回当前节点需要预拉取的镜像，这些镜像不会被回收
+func (p *Prepuller) Wanted() map[string]bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	wanted := make(map[string]bool, len(p.status))
+	for name := range p.status {
+		wanted[name] = true
+	}
+	return wanted
+}
+
+func (p *Prepuller) sync(cm *corev1.ConfigMap) {
+
+	wanted, err := p.wantedImages(cm)
+	if err != nil {
+		log.ErrorLogMsg("Sync prepull config %s/%s failed: %v", p.namespace, p.name, err)
+		return
+	}
+
+	var pulls []string
+
+	p.mu.Lock()
+	for name := range p.status {
+		if !wanted[name] {
+			delete(p.status, name)
+		}
+	}
+	for name := range wanted {
+		if s, ok := p.status[name]; ok && s.State != PrepullStateFailed {
+			continue
+		}
+		p.status[name] = &PrepullStatus{State: PrepullStatePulling}
+		pulls = append(pulls, name)
+	}
+	p.mu.Unlock()
+
+	sort.Strings(pulls)
+	for _, name := range pulls {
+		go p.pull(name)
+	}
+
+	p.report()
+}
+
+func (p *Prepuller) wantedImages(cm *corev1.ConfigMap) (map[string]bool, error) {
+
+	wanted := make(map[string]bool)
+	if cm == nil || cm.Data[PrepullConfigKey] == "" {
+		return wanted, nil
+	}
+
+	var images []PrepullImage
+	if err := yaml.Unmarshal([]byte(cm.Data[PrepullConfigKey]), &images); err != nil {
+		return nil, errors.Wrap(err, "parse prepull images")
+	}
+
+	node, err := p.client.CoreV1().Nodes().Get(context.Background(), p.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "get node %s", p.nodeName)
+	}
+
+	for _, img := range images {
+		if err = ValidateName(img.Name); err != nil {
+			log.WarningLogMsg("Skip prepull image: %v", err)
+			continue
+		}
+		if labels.SelectorFromSet(img.NodeSelector).Matches(labels.Set(node.Labels)) {
+			wanted[img.Name] = true
+		}
+	}
+
+	return wanted, nil
+}
+
+func (p *Prepuller) pull(name string) {
+
+	status := &PrepullStatus{State: PrepullStateReady}
+	if _, err := p.manager.Ensure(context.Background(), name); err != nil {
+		log.ErrorLogMsg("Prepull image %s failed: %v", name, err)
+		status = &PrepullStatus{State: PrepullStateFailed, Message: err.Error()}
+	} else if manifest, err := p.manager.Store().LoadManifest(name); err == nil {
+		status.Digest = manifest.Digest
+	}
+
+	p.mu.Lock()
+	if _, ok := p.status[name]; ok {
+		p.status[name] = status
+	}
+	p.mu.Unlock()
+
+	p.report()
+}
+
+// report 将预拉取状态更新到节点注解中
+func (p *Prepuller) report() {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b, err := json.Marshal(p.status)
+	if err != nil {
+		log.ErrorLogMsg("Encode prepull status failed: %v", err)
+		return
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{PrepullStatusAnnotation: string(b)},
+		},
+	})
+	if err != nil {
+		log.ErrorLogMsg("Encode prepull status failed: %v", err)
+		return
+	}
+
+	_, err = p.client.CoreV1().Nodes().Patch(context.Background(), p.nodeName, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		log.ErrorLogMsg("Update prepull status of node %s failed: %v", p.nodeName, err)
+	}
+}
@@ -0,0 +1,109 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// nodePrepullStatus 读取节点注解中的预拉取状态
+func nodePrepullStatus(t *testing.T, p *Prepuller) map[string]*PrepullStatus {
+	t.Helper()
+
+	node, err := p.client.CoreV1().Nodes().Get(context.Background(), p.nodeName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := make(map[string]*PrepullStatus)
+	if s, ok := node.Annotations[PrepullStatusAnnotation]; ok {
+		if err = json.Unmarshal([]byte(s), &status); err != nil {
+			t.Fatalf("decode prepull status %q: %v", s, err)
+		}
+	}
+	return status
+}
+
+func TestPrepullerSync(t *testing.T) {
+
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{"zone": "a"}}}
+	client := fake.NewSimpleClientset(node)
+
+	store := NewStore(t.TempDir())
+	if err := os.MkdirAll(store.Dir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	temp := store.TempPath("local.qcow2")
+	if err := os.WriteFile(temp, []byte("local"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Register(temp, &Manifest{Name: "local.qcow2", Digest: "sha256:local"}); err != nil {
+		t.Fatal(err)
+	}
+
+	verifier, err := NewVerifier("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 没有下载源，本地不存在的镜像拉取失败
+	p := NewPrepuller(client, NewManager(store, nil, verifier), "node-1", "kube-system", "extrootfs-prepull")
+
+	cm := &corev1.ConfigMap{Data: map[string]string{PrepullConfigKey: `
+- name: local.qcow2
+- name: missing.qcow2
+- name: zone-b.qcow2
+  nodeSelector:
+    zone: b
+- name: ../invalid.qcow2
+`}}
+	p.sync(cm)
+
+	want := map[string]*PrepullStatus{
+		"local.qcow2":   {State: PrepullStateReady, Digest: "sha256:local"},
+		"missing.qcow2": {State: PrepullStateFailed},
+	}
+	var status map[string]*PrepullStatus
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		status = nodePrepullStatus(t, p)
+		local, missing := status["local.qcow2"], status["missing.qcow2"]
+		if local != nil && local.State == PrepullStateReady && missing != nil && missing.State == PrepullStateFailed {
+			break
+		}
+	}
+	// 失败信息来自镜像管理器，只比较状态
+	if s := status["missing.qcow2"]; s != nil {
+		s.Message = ""
+	}
+	if !reflect.DeepEqual(status, want) {
+		t.Fatalf("prepull status = %v, want %v", status, want)
+	}
+
+	if wanted := p.Wanted(); !reflect.DeepEqual(wanted, map[string]bool{"local.qcow2": true, "missing.qcow2": true}) {
+		t.Errorf("Wanted() = %v", wanted)
+	}
+
+	// ConfigMap 删除后不再保留任何镜像
+	p.sync(nil)
+	if wanted := p.Wanted(); len(wanted) != 0 {
+		t.Errorf("Wanted() after delete = %v, want empty", wanted)
+	}
+	if status = nodePrepullStatus(t, p); len(status) != 0 {
+		t.Errorf("prepull status after delete = %v, want empty", status)
+	}
+}
+
+func TestPrepullerInvalidConfig(t *testing.T) {
+
+	client := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}})
+	p := NewPrepuller(client, nil, "node-1", "kube-system", "extrootfs-prepull")
+
+	if _, err := p.wantedImages(&corev1.ConfigMap{Data: map[string]string{PrepullConfigKey: "name: not-a-list"}}); err == nil {
+		t.Error("wantedImages with invalid config succeeded, want error")
+	}
+}
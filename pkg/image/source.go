@@ -0,0 +1,367 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	sourceSchemeHTTP  = "http"
+	sourceSchemeHTTPS = "https"
+	sourceSchemeOCI   = "oci"
+
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociTitleAnnotation   = "org.opencontainers.image.title"
+)
+
+// Source 是基础镜像的下载源
+type Source interface {
+	// Open 返回镜像内容以及期望的 sha256 摘要（sha256:<hex>）
+	Open(ctx context.Context, name string) (io.ReadCloser, string, error)
+	// String 返回用于记录的下载源地址
+	String() string
+}
+
+// NewSource 根据地址创建下载源：
+//   - http(s)://host/path：从 <url>/<name> 下载镜像，从 <url>/<name>.sha256 读取摘要
+//   - oci://[user:password@]registry/repository：镜像以 OCI artifact 的形式保存在 <repository>:<name> 中，
+//     签名保存在同一 artifact 中 title 为 <name>.sig 的 layer
+func NewSource(source string) (Source, error) {
+
+	u, err := url.Parse(source)
+	if err != nil {
+		// 解析错误包含完整的地址，地址中可能有密码
+		return nil, errors.New("parse image source: invalid url")
+	}
+
+	switch u.Scheme {
+	case sourceSchemeHTTP, sourceSchemeHTTPS:
+		return &httpSource{base: strings.TrimSuffix(source, "/"), redacted: strings.TrimSuffix(u.Redacted(), "/"), client: newHTTPClient()}, nil
+	case sourceSchemeOCI:
+		repository := strings.Trim(u.Path, "/")
+		if u.Host == "" || repository == "" {
+			return nil, fmt.Errorf("invalid oci image source %s", u.Redacted())
+		}
+		return &ociSource{registry: u.Host, repository: repository, user: u.User, client: newHTTPClient()}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported image source %s", u.Redacted())
+}
+
+// newHTTPClient 创建下载使用的客户端，限制建立连接和等待响应的时间，
+// 镜像可能很大，下载内容的时间由调用方的 ctx 控制
+func newHTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: time.Minute,
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}
+}
+
+// signatureSource 是可以提供镜像签名的下载源
+type signatureSource interface {
+	OpenSignature(ctx context.Context, name string) (io.ReadCloser, error)
+}
+
+type httpSource struct {
+	base string
+	// redacted 隐藏了密码的地址，用于日志和 manifest
+	redacted string
+	client   *http.Client
+}
+
+func (s *httpSource) String() string {
+	return s.redacted
+}
+
+func (s *httpSource) Open(ctx context.Context, name string) (io.ReadCloser, string, error) {
+
+	sum, err := s.get(ctx, name+".sha256")
+	if err != nil {
+		return nil, "", err
+	}
+	b, err := io.ReadAll(io.LimitReader(sum, 1024))
+	sum.Close()
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "read digest of %s", name)
+	}
+
+	// 兼容 sha256sum 的输出格式：<hex>  <file>
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return nil, "", fmt.Errorf("empty digest of %s", name)
+	}
+	digest := fields[0]
+	if !strings.HasPrefix(digest, digestPrefix) {
+		digest = digestPrefix + digest
+	}
+
+	body, err := s.get(ctx, name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return body, digest, nil
+}
+
+// OpenSignature 从 <url>/<name>.sig 下载镜像签名
+func (s *httpSource) OpenSignature(ctx context.Context, name string) (io.ReadCloser, error) {
+	return s.get(ctx, name+signatureSuffix)
+}
+
+func (s *httpSource) get(ctx context.Context, name string) (io.ReadCloser, error) {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.base+"/"+url.PathEscape(name), nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url %s/%s", s, name)
+	}
+
+	// client 返回的错误包含完整的 url，不能直接记录
+	resp, err := s.client.Do(req)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return nil, errors.Wrapf(err, "download %s", req.URL.Redacted())
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("download %s: %s", req.URL.Redacted(), resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+type ociSource struct {
+	registry   string
+	repository string
+	user       *url.Userinfo
+	client     *http.Client
+
+	mu    sync.Mutex
+	token string
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	Layers []ociDescriptor `json:"layers"`
+}
+
+func (s *ociSource) String() string {
+	return sourceSchemeOCI + "://" + s.registry + "/" + s.repository
+}
+
+func (s *ociSource) Open(ctx context.Context, name string) (io.ReadCloser, string, error) {
+
+	manifest, err := s.manifest(ctx, name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// 优先使用 title 与镜像名称相同的 layer，否则要求 artifact 只包含一个镜像 layer
+	layer := manifest.layer(name)
+	if layer == nil && len(manifest.Layers) == 1 {
+		layer = &manifest.Layers[0]
+	}
+	if layer == nil {
+		return nil, "", fmt.Errorf("no layer for %s in %s", name, s)
+	}
+
+	blob, err := s.get(ctx, "blobs/"+layer.Digest, "")
+	if err != nil {
+		return nil, "", err
+	}
+
+	return blob, layer.Digest, nil
+}
+
+// OpenSignature 读取 artifact 中 title 为 <name>.sig 的 layer，
+// 例如 oras push <registry>/<repository>:<name> <name> <name>.sig
+func (s *ociSource) OpenSignature(ctx context.Context, name string) (io.ReadCloser, error) {
+
+	manifest, err := s.manifest(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	layer := manifest.layer(name + signatureSuffix)
+	if layer == nil {
+		return nil, fmt.Errorf("no signature layer for %s in %s", name, s)
+	}
+
+	return s.get(ctx, "blobs/"+layer.Digest, "")
+}
+
+func (s *ociSource) manifest(ctx context.Context, name string) (*ociManifest, error) {
+
+	body, err := s.get(ctx, "manifests/"+name, ociManifestMediaType)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	manifest := &ociManifest{}
+	if err = json.NewDecoder(body).Decode(manifest); err != nil {
+		return nil, errors.Wrapf(err, "decode manifest of %s", name)
+	}
+
+	return manifest, nil
+}
+
+// layer 返回 title 为 title 的 layer
+func (m *ociManifest) layer(title string) *ociDescriptor {
+	for i := range m.Layers {
+		if m.Layers[i].Annotations[ociTitleAnnotation] == title {
+			return &m.Layers[i]
+		}
+	}
+	return nil
+}
+
+func (s *ociSource) get(ctx context.Context, resource, accept string) (io.ReadCloser, error) {
+
+	u := fmt.Sprintf("https://%s/v2/%s/%s", s.registry, s.repository, resource)
+
+	resp, err := s.do(ctx, u, accept)
+	if err != nil {
+		return nil, err
+	}
+
+	// 根据 registry 返回的认证要求获取 token 后重试
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		token, err := s.authorize(ctx, challenge)
+		if err != nil {
+			return nil, err
+		}
+		s.setToken(token)
+		if resp, err = s.do(ctx, u, accept); err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("download %s: %s", u, resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+func (s *ociSource) do(ctx context.Context, u, accept string) (*http.Response, error) {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if token := s.getToken(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if s.user != nil {
+		password, _ := s.user.Password()
+		req.SetBasicAuth(s.user.Username(), password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "download %s", u)
+	}
+
+	return resp, nil
+}
+
+func (s *ociSource) getToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.token
+}
+
+func (s *ociSource) setToken(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = token
+}
+
+// authorize 按照 Docker registry token 认证流程获取 token
+func (s *ociSource) authorize(ctx context.Context, challenge string) (string, error) {
+
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return "", fmt.Errorf("unsupported auth challenge %q from %s", challenge, s.registry)
+	}
+
+	params := map[string]string{}
+	for _, kv := range strings.Split(strings.TrimPrefix(challenge, "Bearer "), ",") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(kv), "="); ok {
+			params[k] = strings.Trim(v, `"`)
+		}
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.String() == "" {
+		return "", fmt.Errorf("invalid auth realm in %q", challenge)
+	}
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	query.Set("scope", fmt.Sprintf("repository:%s:pull", s.repository))
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if s.user != nil {
+		password, _ := s.user.Password()
+		req.SetBasicAuth(s.user.Username(), password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "get token from %s", realm.Host)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("get token from %s: %s", realm.Host, resp.Status)
+	}
+
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", errors.Wrapf(err, "decode token from %s", realm.Host)
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+
+	return token.AccessToken, nil
+}
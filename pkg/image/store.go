@@ -0,0 +1,143 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	manifestSuffix = ".json"
+	digestPrefix   = "sha256:"
+)
+
+// Manifest 记录基础镜像的元数据，与镜像文件一起保存在镜像目录中
+type Manifest struct {
+	Name        string    `json:"name"`
+	Digest      string    `json:"digest"`
+	Format      string    `json:"format"`
+	VirtualSize int64     `json:"virtual_size"`
+	Source      string    `json:"source,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	// Pulled 镜像由 Manager 从下载源拉取，可以再次下载，只有这样的镜像会被回收
+	Pulled bool `json:"pulled,omitempty"`
+	// 通过 OCI 镜像构建的磁盘镜像记录源镜像的摘要、文件系统中 rootfs 的内容摘要和文件系统类型
+	SourceDigest   string `json:"source_digest,omitempty"`
+	ContentDigest  string `json:"content_digest,omitempty"`
+	FileSystemType string `json:"fs_type,omitempty"`
+}
+
+// Store 管理节点上 <base>/qemu/images 目录中的基础镜像
+type Store struct {
+	dir string
+}
+
+func NewStore(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// Path 返回镜像文件的路径
+func (s *Store) Path(name string) string {
+	return path.Join(s.dir, name)
+}
+
+func (s *Store) manifestPath(name string) string {
+	return path.Join(s.dir, name+manifestSuffix)
+}
+
+// Exists 判断镜像文件是否已经存在
+func (s *Store) Exists(name string) bool {
+	_, err := os.Stat(s.Path(name))
+	return err == nil
+}
+
+// TempPath 返回镜像目录中的临时文件路径，写入完成后通过 Register 重命名，保证镜像文件的原子性
+func (s *Store) TempPath(name string) string {
+	return path.Join(s.dir, fmt.Sprintf(".%s.%d.tmp", name, time.Now().UnixNano()))
+}
+
+// Register 将临时文件移动到镜像目录并写入元数据
+func (s *Store) Register(temp string, manifest *Manifest) error {
+
+	if err := ValidateName(manifest.Name); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.Wrap(err, "image.Register")
+	}
+
+	// 先写元数据再移动镜像文件，镜像文件存在即表示镜像可用
+	if err = writeFileAtomic(s.manifestPath(manifest.Name), b, 0644); err != nil {
+		return errors.Wrap(err, "image.Register")
+	}
+
+	if err = os.Rename(temp, s.Path(manifest.Name)); err != nil {
+		return errors.Wrap(err, "image.Register")
+	}
+
+	return nil
+}
+
+// LoadManifest 读取镜像的元数据
+func (s *Store) LoadManifest(name string) (*Manifest, error) {
+
+	b, err := os.ReadFile(s.manifestPath(name))
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{}
+	if err = json.Unmarshal(b, manifest); err != nil {
+		return nil, errors.Wrapf(err, "load manifest of %s", name)
+	}
+
+	return manifest, nil
+}
+
+// ValidateName 检查镜像名称，镜像名称直接作为镜像目录中的文件名
+func ValidateName(name string) error {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") || strings.HasSuffix(name, manifestSuffix) || strings.HasSuffix(name, signatureSuffix) {
+		return fmt.Errorf("invalid image name %q", name)
+	}
+	return nil
+}
+
+// FileDigest 计算文件的 sha256 摘要
+func FileDigest(name string) (string, error) {
+
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", errors.Wrapf(err, "digest %s", name)
+	}
+
+	return digestPrefix + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	temp := name + ".tmp"
+	if err := os.WriteFile(temp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(temp, name)
+}
@@ -0,0 +1,324 @@
+package treedigest
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/QQGoblin/extrootfs/pkg/image/oci"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	mount "k8s.io/mount-utils"
+)
+
+const (
+	digestPrefix   = "sha256:"
+	xattrPAXPrefix = "SCHILY.xattr."
+	// mkfs.ext4 在根目录创建的目录，不属于 rootfs 的内容
+	lostAndFound = "lost+found"
+	// 挂载时由宿主机打上的 SELinux 标签与内容无关
+	xattrSELinux = "security.selinux"
+)
+
+const (
+	typeDir     = "dir"
+	typeFile    = "file"
+	typeSymlink = "symlink"
+	typeChar    = "char"
+	typeBlock   = "block"
+	typeFifo    = "fifo"
+)
+
+// Entry 是参与摘要计算的文件记录。
+// 时间戳、inode 以及硬链接关系不参与计算，硬链接视为内容相同的普通文件，符号链接不记录权限。
+type Entry struct {
+	Path     string            `json:"path"`
+	Type     string            `json:"type"`
+	Mode     int64             `json:"mode"`
+	UID      int               `json:"uid"`
+	GID      int               `json:"gid"`
+	Size     int64             `json:"size,omitempty"`
+	Digest   string            `json:"digest,omitempty"`
+	Linkname string            `json:"linkname,omitempty"`
+	DevMajor int64             `json:"dev_major,omitempty"`
+	DevMinor int64             `json:"dev_minor,omitempty"`
+	Xattrs   map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// Digest 计算 rootfs 的内容摘要：按路径排序后对每个文件的规范化记录逐行计算 sha256。
+// 相同内容的 rootfs 无论来自 OCI 镜像、目录还是磁盘设备，得到的摘要都相同。
+func Digest(entries []*Entry) (string, error) {
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+
+	h := sha256.New()
+	for _, e := range entries {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return "", err
+		}
+		h.Write(b)
+		h.Write([]byte{'\n'})
+	}
+
+	return digestPrefix + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// FromImage 合并 OCI 镜像的所有 layer 后计算摘要
+func FromImage(input, ref, contentDir string) (string, error) {
+
+	img, err := oci.Load(input, ref)
+	if err != nil {
+		return "", errors.Wrap(err, "load image")
+	}
+
+	rootfs, err := oci.Flatten(img, contentDir)
+	if err != nil {
+		return "", errors.Wrap(err, "flatten image")
+	}
+	defer rootfs.Close()
+
+	return FromRootFS(rootfs)
+}
+
+// FromRootFS 计算合并后的 rootfs 的摘要
+func FromRootFS(rootfs *oci.RootFS) (string, error) {
+
+	var entries []*Entry
+	for _, name := range rootfs.Names() {
+		if isExcluded(name) {
+			continue
+		}
+
+		e := rootfs.Get(name)
+		h := e.Header
+		entry := &Entry{
+			Path: name,
+			Mode: h.Mode & 07777,
+			UID:  h.Uid,
+			GID:  h.Gid,
+		}
+
+		switch h.Typeflag {
+		case tar.TypeDir:
+			entry.Type = typeDir
+		case tar.TypeReg:
+			entry.Type = typeFile
+			entry.Size = h.Size
+			entry.Digest = e.Digest
+		case tar.TypeSymlink:
+			entry.Type = typeSymlink
+			entry.Mode = 0
+			entry.Linkname = h.Linkname
+		case tar.TypeChar:
+			entry.Type = typeChar
+			entry.DevMajor, entry.DevMinor = h.Devmajor, h.Devminor
+		case tar.TypeBlock:
+			entry.Type = typeBlock
+			entry.DevMajor, entry.DevMinor = h.Devmajor, h.Devminor
+		case tar.TypeFifo:
+			entry.Type = typeFifo
+		default:
+			return "", errors.Errorf("unsupported file type %c of %s", h.Typeflag, name)
+		}
+
+		for k, v := range h.PAXRecords {
+			if key := strings.TrimPrefix(k, xattrPAXPrefix); key != k && key != xattrSELinux {
+				if entry.Xattrs == nil {
+					entry.Xattrs = make(map[string][]byte)
+				}
+				entry.Xattrs[key] = []byte(v)
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return Digest(entries)
+}
+
+// FromDir 计算目录中的 rootfs 的摘要，不跟随符号链接
+func FromDir(root string) (string, error) {
+
+	var entries []*Entry
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if name == "." {
+			return nil
+		}
+		if isExcluded(name) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		entry, err := dirEntry(p, name)
+		if err != nil {
+			return errors.Wrapf(err, "read %s", p)
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return Digest(entries)
+}
+
+func dirEntry(p, name string) (*Entry, error) {
+
+	st := &unix.Stat_t{}
+	if err := unix.Lstat(p, st); err != nil {
+		return nil, err
+	}
+
+	entry := &Entry{
+		Path: name,
+		Mode: int64(st.Mode & 07777),
+		UID:  int(st.Uid),
+		GID:  int(st.Gid),
+	}
+
+	var err error
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		entry.Type = typeDir
+	case syscall.S_IFREG:
+		entry.Type = typeFile
+		entry.Size = st.Size
+		if entry.Digest, err = fileDigest(p); err != nil {
+			return nil, err
+		}
+	case syscall.S_IFLNK:
+		entry.Type = typeSymlink
+		entry.Mode = 0
+		if entry.Linkname, err = os.Readlink(p); err != nil {
+			return nil, err
+		}
+	case syscall.S_IFCHR:
+		entry.Type = typeChar
+		entry.DevMajor, entry.DevMinor = int64(unix.Major(uint64(st.Rdev))), int64(unix.Minor(uint64(st.Rdev)))
+	case syscall.S_IFBLK:
+		entry.Type = typeBlock
+		entry.DevMajor, entry.DevMinor = int64(unix.Major(uint64(st.Rdev))), int64(unix.Minor(uint64(st.Rdev)))
+	case syscall.S_IFIFO:
+		entry.Type = typeFifo
+	default:
+		return nil, errors.Errorf("unsupported file mode %o", st.Mode)
+	}
+
+	if entry.Xattrs, err = xattrs(p); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// FromDevice 以只读方式挂载设备后计算摘要
+func FromDevice(device, fsType, mountPoint string) (digest string, err error) {
+
+	if err = os.MkdirAll(mountPoint, 0755); err != nil {
+		return "", err
+	}
+	defer os.Remove(mountPoint)
+
+	options := []string{"ro"}
+	if fsType == "xfs" {
+		// 只读挂载时不回放日志，避免修改设备
+		options = append(options, "norecovery")
+	}
+
+	mounter := mount.NewWithoutSystemd("")
+	if err = mounter.Mount(device, mountPoint, fsType, options); err != nil {
+		return "", err
+	}
+	defer func() {
+		if umountErr := mounter.Unmount(mountPoint); umountErr != nil && err == nil {
+			err = umountErr
+		}
+	}()
+
+	return FromDir(mountPoint)
+}
+
+func xattrs(p string) (map[string][]byte, error) {
+
+	size, err := unix.Llistxattr(p, nil)
+	if err != nil {
+		if err == unix.ENOTSUP {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(p, buf); err != nil {
+		return nil, err
+	}
+
+	var result map[string][]byte
+	for _, key := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if key == "" || key == xattrSELinux {
+			continue
+		}
+
+		n, err := unix.Lgetxattr(p, key, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, n)
+		if n, err = unix.Lgetxattr(p, key, value); err != nil {
+			return nil, err
+		}
+
+		if result == nil {
+			result = make(map[string][]byte)
+		}
+		result[key] = value[:n]
+	}
+
+	return result, nil
+}
+
+func fileDigest(p string) (string, error) {
+
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return digestPrefix + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func isExcluded(name string) bool {
+	return name == lostAndFound
+}
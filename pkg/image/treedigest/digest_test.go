@@ -0,0 +1,159 @@
+package treedigest
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+)
+
+// testTree 同时写入 docker-archive 和目录的 rootfs，属主为当前用户以便非 root 用户也能创建目录
+func testTree(t *testing.T) (archive, dir string) {
+	t.Helper()
+
+	uid, gid := os.Getuid(), os.Getgid()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	headers := []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0644, Size: 7},
+		{Typeflag: tar.TypeSymlink, Name: "etc/localtime", Linkname: "/usr/share/zoneinfo/UTC", Mode: 0777},
+		{Typeflag: tar.TypeDir, Name: "bin/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "bin/sh", Mode: 0755, Size: 4},
+		{Typeflag: tar.TypeLink, Name: "bin/ash", Linkname: "bin/sh"},
+		{Typeflag: tar.TypeDir, Name: "tmp/", Mode: 01777},
+	}
+	contents := map[string]string{"etc/hostname": "rootfs\n", "bin/sh": "#!sh"}
+	for _, h := range headers {
+		h.Uid, h.Gid = uid, gid
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(contents[h.Name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	archive = t.TempDir()
+	manifest, _ := json.Marshal([]map[string]interface{}{
+		{"Config": "config.json", "RepoTags": []string{"rootfs:latest"}, "Layers": []string{"layer.tar"}},
+	})
+	for name, data := range map[string][]byte{"manifest.json": manifest, "config.json": []byte("{}"), "layer.tar": buf.Bytes()} {
+		if err := os.WriteFile(path.Join(archive, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir = t.TempDir()
+	mustDo := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustDo(os.Mkdir(path.Join(dir, "etc"), 0755))
+	mustDo(os.WriteFile(path.Join(dir, "etc/hostname"), []byte(contents["etc/hostname"]), 0644))
+	mustDo(os.Symlink("/usr/share/zoneinfo/UTC", path.Join(dir, "etc/localtime")))
+	mustDo(os.Mkdir(path.Join(dir, "bin"), 0755))
+	mustDo(os.WriteFile(path.Join(dir, "bin/sh"), []byte(contents["bin/sh"]), 0755))
+	mustDo(os.Link(path.Join(dir, "bin/sh"), path.Join(dir, "bin/ash")))
+	mustDo(os.Mkdir(path.Join(dir, "tmp"), 0755))
+	// 不受 umask 影响
+	mustDo(os.Chmod(path.Join(dir, "etc/hostname"), 0644))
+	mustDo(os.Chmod(path.Join(dir, "bin/sh"), 0755))
+	mustDo(os.Chmod(path.Join(dir, "tmp"), os.ModeSticky|0777))
+
+	return archive, dir
+}
+
+func TestImageAndDirDigestEqual(t *testing.T) {
+
+	archive, dir := testTree(t)
+
+	fromImage, err := FromImage(archive, "", t.TempDir())
+	if err != nil {
+		t.Fatalf("FromImage: %v", err)
+	}
+	fromDir, err := FromDir(dir)
+	if err != nil {
+		t.Fatalf("FromDir: %v", err)
+	}
+	if fromImage != fromDir {
+		t.Errorf("FromImage = %s, FromDir = %s", fromImage, fromDir)
+	}
+
+	// mkfs 创建的 lost+found 不属于 rootfs 的内容
+	if err = os.Mkdir(path.Join(dir, lostAndFound), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if withLostFound, err := FromDir(dir); err != nil || withLostFound != fromDir {
+		t.Errorf("FromDir with lost+found = %s (%v), want %s", withLostFound, err, fromDir)
+	}
+}
+
+func TestDirDigestChanges(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		modify func(dir string) error
+	}{
+		{name: "content", modify: func(dir string) error {
+			return os.WriteFile(path.Join(dir, "etc/hostname"), []byte("changed\n"), 0644)
+		}},
+		{name: "mode", modify: func(dir string) error {
+			return os.Chmod(path.Join(dir, "etc/hostname"), 0600)
+		}},
+		{name: "symlink target", modify: func(dir string) error {
+			if err := os.Remove(path.Join(dir, "etc/localtime")); err != nil {
+				return err
+			}
+			return os.Symlink("/usr/share/zoneinfo/Asia/Shanghai", path.Join(dir, "etc/localtime"))
+		}},
+		{name: "new file", modify: func(dir string) error {
+			return os.WriteFile(path.Join(dir, "etc/hosts"), nil, 0644)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, dir := testTree(t)
+			before, err := FromDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = tt.modify(dir); err != nil {
+				t.Fatal(err)
+			}
+			after, err := FromDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if before == after {
+				t.Errorf("digest %s is not changed", before)
+			}
+		})
+	}
+}
+
+func TestDigestIgnoresOrder(t *testing.T) {
+
+	a := []*Entry{{Path: "a", Type: typeFile}, {Path: "b", Type: typeDir}}
+	b := []*Entry{{Path: "b", Type: typeDir}, {Path: "a", Type: typeFile}}
+
+	da, err := Digest(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := Digest(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if da != db {
+		t.Errorf("Digest depends on entry order: %s != %s", da, db)
+	}
+}
@@ -0,0 +1,184 @@
+package image
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+const signatureSuffix = ".sig"
+
+// Verifier 校验基础镜像的摘要和签名，校验结果按照 inode 和 mtime 缓存，镜像文件不变时不会重复计算
+type Verifier struct {
+	publicKey crypto.PublicKey
+
+	mu    sync.Mutex
+	cache map[string]*verifyResult
+}
+
+type verifyResult struct {
+	ino    uint64
+	size   int64
+	mtime  int64
+	digest string
+	// 签名已通过公钥校验
+	signed bool
+}
+
+// NewVerifier 创建校验器，publicKeyFile 为空时不校验签名。
+// 公钥为 PEM 格式的 RSA 或 ECDSA 公钥，签名文件 <image>.sig 与镜像保存在同一目录，
+// 可以通过 openssl dgst -sha256 -sign <private-key> -out <image>.sig <image> 生成。
+func NewVerifier(publicKeyFile string) (*Verifier, error) {
+
+	v := &Verifier{cache: make(map[string]*verifyResult)}
+	if publicKeyFile == "" {
+		return v, nil
+	}
+
+	b, err := os.ReadFile(publicKeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "read public key")
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", publicKeyFile)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse public key")
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+
+	v.publicKey = key
+	return v, nil
+}
+
+// SignatureRequired 是否配置了公钥
+func (v *Verifier) SignatureRequired() bool {
+	return v.publicKey != nil
+}
+
+// Verify 校验镜像文件，expectedDigest 为空时不校验摘要
+func (v *Verifier) Verify(name, expectedDigest string) error {
+
+	if expectedDigest == "" && v.publicKey == nil {
+		return nil
+	}
+
+	result, err := v.result(name)
+	if err != nil {
+		return err
+	}
+
+	if expectedDigest != "" {
+		if expected := NormalizeDigest(expectedDigest); result.digest != expected {
+			return fmt.Errorf("image %s digest mismatch, expected %s, got %s", name, expected, result.digest)
+		}
+	}
+
+	if v.publicKey != nil && !result.signed {
+		if err = v.verifySignature(name, result.digest); err != nil {
+			return err
+		}
+		v.mu.Lock()
+		result.signed = true
+		v.mu.Unlock()
+	}
+
+	return nil
+}
+
+func (v *Verifier) result(name string) (*verifyResult, error) {
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var ino uint64
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		ino = st.Ino
+	}
+
+	v.mu.Lock()
+	cached, ok := v.cache[name]
+	v.mu.Unlock()
+	if ok && cached.ino == ino && cached.size == fi.Size() && cached.mtime == fi.ModTime().UnixNano() {
+		return cached, nil
+	}
+
+	digest, err := FileDigest(name)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &verifyResult{ino: ino, size: fi.Size(), mtime: fi.ModTime().UnixNano(), digest: digest}
+	v.mu.Lock()
+	v.cache[name] = result
+	v.mu.Unlock()
+
+	return result, nil
+}
+
+func (v *Verifier) verifySignature(name, digest string) error {
+
+	sig, err := os.ReadFile(name + signatureSuffix)
+	if err != nil {
+		return errors.Wrapf(err, "image %s signature", name)
+	}
+
+	hashed, err := hex.DecodeString(strings.TrimPrefix(digest, digestPrefix))
+	if err != nil {
+		return errors.Wrapf(err, "image %s digest", name)
+	}
+
+	switch key := v.publicKey.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed, sig)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, hashed, sig) {
+			err = errors.New("ecdsa verification failure")
+		}
+	}
+	if err != nil {
+		return errors.Wrapf(err, "image %s signature verification failed", name)
+	}
+
+	return nil
+}
+
+// NormalizeDigest 统一摘要格式为 sha256:<hex>
+func NormalizeDigest(digest string) string {
+	digest = strings.ToLower(strings.TrimSpace(digest))
+	if !strings.HasPrefix(digest, digestPrefix) {
+		digest = digestPrefix + digest
+	}
+	return digest
+}
+
+// ValidateDigest 检查 sha256 摘要的格式
+func ValidateDigest(digest string) error {
+	b, err := hex.DecodeString(strings.TrimPrefix(NormalizeDigest(digest), digestPrefix))
+	if err != nil || len(b) != sha256.Size {
+		return fmt.Errorf("invalid sha256 digest %q", digest)
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package image
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writePublicKey 将公钥以 PEM 格式写入文件
+func writePublicKey(t *testing.T, key crypto.PublicKey) string {
+	t.Helper()
+
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := path.Join(t.TempDir(), "key.pub")
+	if err = os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func sign(t *testing.T, key crypto.Signer, data []byte) []byte {
+	t.Helper()
+
+	hashed := sha256.Sum256(data)
+	var opts crypto.SignerOpts = crypto.SHA256
+	sig, err := key.Sign(rand.Reader, hashed[:], opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func TestVerifier(t *testing.T) {
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("base image")
+	sum := sha256.Sum256(data)
+	// 摘要的大小写和前缀不影响校验
+	digest := "SHA256:" + strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	tests := []struct {
+		name      string
+		publicKey crypto.PublicKey
+		signer    crypto.Signer
+		digest    string
+		err       string
+	}{
+		{name: "nothing to verify"},
+		{name: "digest", digest: digest},
+		{name: "digest mismatch", digest: "sha256:" + strings.Repeat("0", 64), err: "digest mismatch"},
+		{name: "rsa signature", publicKey: &rsaKey.PublicKey, signer: rsaKey, digest: digest},
+		{name: "ecdsa signature", publicKey: &ecdsaKey.PublicKey, signer: ecdsaKey},
+		{name: "missing signature", publicKey: &ecdsaKey.PublicKey, err: "signature"},
+		{name: "signed by other key", publicKey: &ecdsaKey.PublicKey, signer: otherKey, err: "signature verification failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			keyFile := ""
+			if tt.publicKey != nil {
+				keyFile = writePublicKey(t, tt.publicKey)
+			}
+			v, err := NewVerifier(keyFile)
+			if err != nil {
+				t.Fatalf("NewVerifier: %v", err)
+			}
+
+			name := path.Join(t.TempDir(), "base.qcow2")
+			if err = os.WriteFile(name, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.signer != nil {
+				if err = os.WriteFile(name+signatureSuffix, sign(t, tt.signer, data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = v.Verify(name, tt.digest)
+			if tt.err == "" && err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("Verify error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestVerifierDetectsModifiedImage(t *testing.T) {
+
+	v, err := NewVerifier("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := path.Join(t.TempDir(), "base.qcow2")
+	if err = os.WriteFile(name, []byte("base image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := FileDigest(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = v.Verify(name, digest); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	// 缓存按照 inode、大小和 mtime 失效
+	if err = os.WriteFile(name, []byte("modified image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err = os.Chtimes(name, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if err = v.Verify(name, digest); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Fatalf("Verify modified image error = %v, want digest mismatch", err)
+	}
+}
+
+func TestNewVerifierInvalidKey(t *testing.T) {
+
+	name := path.Join(t.TempDir(), "key.pub")
+	if err := os.WriteFile(name, []byte("not a key"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewVerifier(name); err == nil {
+		t.Fatal("NewVerifier with invalid key succeeded, want error")
+	}
+}
+
+func TestValidateDigest(t *testing.T) {
+
+	valid := "sha256:" + strings.Repeat("ab", 32)
+	for digest, ok := range map[string]bool{
+		valid:                             true,
+		strings.Repeat("AB", 32):          true,
+		"sha256:1234":                     false,
+		"md5:" + strings.Repeat("ab", 32): false,
+	} {
+		if err := ValidateDigest(digest); (err == nil) != ok {
+			t.Errorf("ValidateDigest(%q) = %v, want valid %t", digest, err, ok)
+		}
+	}
+}
+
+func TestPullSignature(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/base.qcow2"+signatureSuffix {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("signature"))
+	}))
+	defer server.Close()
+
+	source, err := NewSource(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := NewVerifier(writePublicKey(t, &key.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewStore(t.TempDir())
+	if err = os.MkdirAll(store.Dir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(store, source, verifier)
+
+	if err = m.pullSignature(context.Background(), "base.qcow2"); err != nil {
+		t.Fatalf("pullSignature: %v", err)
+	}
+	if b, err := os.ReadFile(store.Path("base.qcow2") + signatureSuffix); err != nil || string(b) != "signature" {
+		t.Errorf("signature = %q (%v), want %q", b, err, "signature")
+	}
+
+	if err = m.pullSignature(context.Background(), "other.qcow2"); err == nil {
+		t.Error("pullSignature of missing signature succeeded, want error")
+	}
+}
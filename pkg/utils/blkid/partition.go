@@ -0,0 +1,141 @@
+package blkid
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/QQGoblin/extrootfs/pkg/utils/log"
+	"github.com/pkg/errors"
+)
+
+const sysClassBlock = "/sys/class/block"
+
+// 卷标为以下名称的分区优先作为根分区
+var rootLabels = []string{"root", "rootfs", "/"}
+
+// Partition 是磁盘上的一个分区
+type Partition struct {
+	Device string `json:"device"`
+	Number int    `json:"number"`
+	Size   int64  `json:"size"`
+	Probe  *Probe `json:"probe,omitempty"`
+}
+
+// Partitions 通过 sysfs 返回磁盘的所有分区，按分区号排序
+func Partitions(device string) ([]*Partition, error) {
+
+	dev, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return nil, errors.Wrap(err, "blkid.Partitions")
+	}
+	name := filepath.Base(dev)
+
+	entries, err := os.ReadDir(path.Join(sysClassBlock, name))
+	if err != nil {
+		return nil, errors.Wrap(err, "blkid.Partitions")
+	}
+
+	var partitions []*Partition
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), name) {
+			continue
+		}
+		dir := path.Join(sysClassBlock, name, entry.Name())
+		number, err := readInt(path.Join(dir, "partition"))
+		if err != nil {
+			continue
+		}
+		sectors, err := readInt(path.Join(dir, "size"))
+		if err != nil {
+			return nil, errors.Wrap(err, "blkid.Partitions")
+		}
+		partitions = append(partitions, &Partition{
+			Device: path.Join("/dev", entry.Name()),
+			Number: int(number),
+			Size:   sectors * 512,
+		})
+	}
+
+	sort.Slice(partitions, func(i, j int) bool {
+		return partitions[i].Number < partitions[j].Number
+	})
+
+	return partitions, nil
+}
+
+// FindRoot 返回磁盘上的根文件系统所在的设备。
+// 磁盘本身包含文件系统时直接返回磁盘；否则在分区中选择卷标为 root/rootfs 的分区，没有时选择最大的包含文件系统的分区。
+// 无法识别文件系统时返回磁盘本身，Probe 为 nil。
+func FindRoot(device string, timeout time.Duration) (string, *Probe, error) {
+
+	p, err := ProbeDevice(device)
+	if err != nil {
+		return "", nil, err
+	}
+	if p != nil {
+		return device, p, nil
+	}
+
+	table, err := ReadPartitionTable(device)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(table) == 0 {
+		return device, nil, nil
+	}
+
+	numbers := make([]int, 0, len(table))
+	for _, entry := range table {
+		numbers = append(numbers, entry.Number)
+	}
+	partitions, err := WaitPartitions(device, numbers, timeout)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var root *Partition
+	for _, part := range partitions {
+		if part.Probe, err = ProbeDevice(part.Device); err != nil {
+			log.WarningLogMsg("Probe partition %s failed: %v", part.Device, err)
+			continue
+		}
+		if part.Probe == nil {
+			continue
+		}
+		if isRootLabel(part.Probe.Label) {
+			root = part
+			break
+		}
+		if root == nil || part.Size > root.Size {
+			root = part
+		}
+	}
+
+	if root == nil {
+		return device, nil, nil
+	}
+
+	return root.Device, root.Probe, nil
+}
+
+func isRootLabel(label string) bool {
+	for _, l := range rootLabels {
+		if strings.EqualFold(label, l) {
+			return true
+		}
+	}
+	return false
+}
+
+func readInt(name string) (int64, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
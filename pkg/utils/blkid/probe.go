@@ -0,0 +1,173 @@
+package blkid
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	TypeExt2     = "ext2"
+	TypeExt3     = "ext3"
+	TypeExt4     = "ext4"
+	TypeXFS      = "xfs"
+	TypeBtrfs    = "btrfs"
+	TypeErofs    = "erofs"
+	TypeSquashfs = "squashfs"
+)
+
+// probeSize 覆盖所有支持的文件系统超级块，btrfs 的超级块位于 64KiB 处
+const probeSize = 0x10000 + 0x1000
+
+const (
+	extSuperblock     = 1024
+	extMagic          = 0xEF53
+	extCompatJournal  = 0x0004
+	ext3IncompatSupp  = 0x0002 | 0x0004 | 0x0010
+	ext3ROCompatSupp  = 0x0001 | 0x0002 | 0x0004
+	erofsSuperblock   = 1024
+	erofsMagic        = 0xE0F5E1E2
+	btrfsSuperblock   = 0x10000
+	btrfsMagic        = "_BHRfS_M"
+	xfsMagic          = "XFSB"
+	squashfsMagic     = "hsqs"
+	squashfsMagicSwap = "sqsh"
+)
+
+// Probe 是设备上识别到的文件系统
+type Probe struct {
+	Type  string `json:"type"`
+	UUID  string `json:"uuid,omitempty"`
+	Label string `json:"label,omitempty"`
+}
+
+// ProbeDevice 读取设备的超级块识别文件系统，无法识别时返回 nil
+func ProbeDevice(device string) (*Probe, error) {
+
+	f, err := os.Open(device)
+	if err != nil {
+		return nil, errors.Wrap(err, "blkid.Probe")
+	}
+	defer f.Close()
+
+	buf := make([]byte, probeSize)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, errors.Wrapf(err, "blkid.Probe: read %s", device)
+	}
+
+	return probe(buf[:n]), nil
+}
+
+func probe(buf []byte) *Probe {
+	for _, fn := range []func([]byte) *Probe{probeXFS, probeExt, probeBtrfs, probeErofs, probeSquashfs} {
+		if p := fn(buf); p != nil {
+			return p
+		}
+	}
+	return nil
+}
+
+func probeExt(buf []byte) *Probe {
+
+	if len(buf) < extSuperblock+136 {
+		return nil
+	}
+	sb := buf[extSuperblock:]
+	if binary.LittleEndian.Uint16(sb[56:]) != extMagic {
+		return nil
+	}
+
+	compat := binary.LittleEndian.Uint32(sb[92:])
+	incompat := binary.LittleEndian.Uint32(sb[96:])
+	roCompat := binary.LittleEndian.Uint32(sb[100:])
+
+	// 与 libblkid 相同：使用了 ext3 不支持的特性即为 ext4
+	fsType := TypeExt2
+	if incompat&^ext3IncompatSupp != 0 || roCompat&^ext3ROCompatSupp != 0 {
+		fsType = TypeExt4
+	} else if compat&extCompatJournal != 0 {
+		fsType = TypeExt3
+	}
+
+	return &Probe{
+		Type:  fsType,
+		UUID:  formatUUID(sb[104:120]),
+		Label: cString(sb[120:136]),
+	}
+}
+
+func probeXFS(buf []byte) *Probe {
+
+	if len(buf) < 120 || string(buf[0:4]) != xfsMagic {
+		return nil
+	}
+
+	return &Probe{
+		Type:  TypeXFS,
+		UUID:  formatUUID(buf[32:48]),
+		Label: cString(buf[108:120]),
+	}
+}
+
+func probeBtrfs(buf []byte) *Probe {
+
+	if len(buf) < btrfsSuperblock+0x22b {
+		return nil
+	}
+	sb := buf[btrfsSuperblock:]
+	if string(sb[0x40:0x48]) != btrfsMagic {
+		return nil
+	}
+
+	return &Probe{
+		Type:  TypeBtrfs,
+		UUID:  formatUUID(sb[0x20:0x30]),
+		Label: cString(sb[0x12b:0x22b]),
+	}
+}
+
+func probeErofs(buf []byte) *Probe {
+
+	if len(buf) < erofsSuperblock+80 {
+		return nil
+	}
+	sb := buf[erofsSuperblock:]
+	if binary.LittleEndian.Uint32(sb[0:]) != erofsMagic {
+		return nil
+	}
+
+	return &Probe{
+		Type:  TypeErofs,
+		UUID:  formatUUID(sb[48:64]),
+		Label: cString(sb[64:80]),
+	}
+}
+
+func probeSquashfs(buf []byte) *Probe {
+
+	if len(buf) < 4 || (string(buf[0:4]) != squashfsMagic && string(buf[0:4]) != squashfsMagicSwap) {
+		return nil
+	}
+
+	// squashfs 没有 UUID 和卷标
+	return &Probe{Type: TypeSquashfs}
+}
+
+func formatUUID(b []byte) string {
+	if bytes.Equal(b, make([]byte, len(b))) {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
@@ -0,0 +1,100 @@
+package blkid
+
+import (
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"testing"
+)
+
+var testUUID = []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+
+const testUUIDString = "12345678-9abc-def0-0123-456789abcdef"
+
+// extSuperblockBuf 构造 ext 文件系统的超级块
+func extSuperblockBuf(compat, incompat, roCompat uint32, label string) []byte {
+	buf := make([]byte, probeSize)
+	sb := buf[extSuperblock:]
+	binary.LittleEndian.PutUint16(sb[56:], extMagic)
+	binary.LittleEndian.PutUint32(sb[92:], compat)
+	binary.LittleEndian.PutUint32(sb[96:], incompat)
+	binary.LittleEndian.PutUint32(sb[100:], roCompat)
+	copy(sb[104:120], testUUID)
+	copy(sb[120:136], label)
+	return buf
+}
+
+func TestProbe(t *testing.T) {
+
+	xfs := make([]byte, probeSize)
+	copy(xfs, xfsMagic)
+	copy(xfs[32:48], testUUID)
+	copy(xfs[108:120], "xfsroot")
+
+	btrfs := make([]byte, probeSize)
+	copy(btrfs[btrfsSuperblock+0x20:], testUUID)
+	copy(btrfs[btrfsSuperblock+0x40:], btrfsMagic)
+	copy(btrfs[btrfsSuperblock+0x12b:], "btrfsroot")
+
+	erofs := make([]byte, probeSize)
+	binary.LittleEndian.PutUint32(erofs[erofsSuperblock:], erofsMagic)
+	copy(erofs[erofsSuperblock+48:], testUUID)
+	copy(erofs[erofsSuperblock+64:], "erofsroot")
+
+	squashfs := make([]byte, probeSize)
+	copy(squashfs, squashfsMagic)
+
+	tests := []struct {
+		name string
+		buf  []byte
+		want *Probe
+	}{
+		{name: "ext2", buf: extSuperblockBuf(0, 0, 0, "root"), want: &Probe{Type: TypeExt2, UUID: testUUIDString, Label: "root"}},
+		{name: "ext3", buf: extSuperblockBuf(extCompatJournal, 0x0002, 0x0001, ""), want: &Probe{Type: TypeExt3, UUID: testUUIDString}},
+		// extents 和 64bit 特性 ext3 不支持
+		{name: "ext4", buf: extSuperblockBuf(extCompatJournal, 0x0002|0x0040|0x0080, 0x0001, "rootfs"), want: &Probe{Type: TypeExt4, UUID: testUUIDString, Label: "rootfs"}},
+		{name: "xfs", buf: xfs, want: &Probe{Type: TypeXFS, UUID: testUUIDString, Label: "xfsroot"}},
+		{name: "btrfs", buf: btrfs, want: &Probe{Type: TypeBtrfs, UUID: testUUIDString, Label: "btrfsroot"}},
+		{name: "erofs", buf: erofs, want: &Probe{Type: TypeErofs, UUID: testUUIDString, Label: "erofsroot"}},
+		{name: "squashfs", buf: squashfs, want: &Probe{Type: TypeSquashfs}},
+		{name: "unknown", buf: make([]byte, probeSize)},
+		{name: "short", buf: make([]byte, 512)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := probe(tt.buf); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("probe() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeDeviceExt4(t *testing.T) {
+
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 is not installed")
+	}
+
+	device := path.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(device, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(device, 16<<20); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("mkfs.ext4", "-F", "-q", "-L", "rootfs", "-U", testUUIDString, device).CombinedOutput(); err != nil {
+		t.Fatalf("mkfs.ext4: %v: %s", err, out)
+	}
+
+	p, err := ProbeDevice(device)
+	if err != nil {
+		t.Fatalf("ProbeDevice: %v", err)
+	}
+	want := &Probe{Type: TypeExt4, UUID: testUUIDString, Label: "rootfs"}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("ProbeDevice() = %+v, want %+v", p, want)
+	}
+}
@@ -0,0 +1,154 @@
+package blkid
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	selectorLabel    = "label"
+	selectorPartUUID = "partuuid"
+	selectorType     = "type"
+
+	// PartitionTimeout 重新读取分区表后等待分区设备出现的时间
+	PartitionTimeout = 30 * time.Second
+	partitionPoll    = 500 * time.Millisecond
+)
+
+// Selector 指定根文件系统所在的分区，支持以下格式：
+// <分区号>、label=<卷标>、partuuid=<PARTUUID>、type=<GPT 分区类型 GUID 或 MBR 分区类型>
+type Selector struct {
+	Number   int
+	Label    string
+	PartUUID string
+	TypeGUID string
+}
+
+func ParseSelector(s string) (*Selector, error) {
+
+	key, value, ok := strings.Cut(s, "=")
+	if !ok {
+		number, err := strconv.Atoi(s)
+		if err != nil || number <= 0 {
+			return nil, fmt.Errorf("invalid partition selector %q", s)
+		}
+		return &Selector{Number: number}, nil
+	}
+
+	if value == "" {
+		return nil, fmt.Errorf("invalid partition selector %q", s)
+	}
+
+	switch strings.ToLower(key) {
+	case selectorLabel:
+		return &Selector{Label: value}, nil
+	case selectorPartUUID:
+		return &Selector{PartUUID: strings.ToLower(value)}, nil
+	case selectorType:
+		return &Selector{TypeGUID: strings.ToLower(value)}, nil
+	}
+
+	return nil, fmt.Errorf("invalid partition selector %q", s)
+}
+
+func (s *Selector) String() string {
+	switch {
+	case s.Label != "":
+		return selectorLabel + "=" + s.Label
+	case s.PartUUID != "":
+		return selectorPartUUID + "=" + s.PartUUID
+	case s.TypeGUID != "":
+		return selectorType + "=" + s.TypeGUID
+	}
+	return strconv.Itoa(s.Number)
+}
+
+// match 根据分区表判断分区是否匹配，按卷标选择时需要识别分区中的文件系统
+func (s *Selector) match(entry *TableEntry) bool {
+	switch {
+	case s.PartUUID != "":
+		return entry.PartUUID == s.PartUUID
+	case s.TypeGUID != "":
+		return entry.TypeGUID == s.TypeGUID
+	case s.Number > 0:
+		return entry.Number == s.Number
+	}
+	return true
+}
+
+// FindPartition 根据分区表选择分区，等待分区设备出现后识别其中的文件系统
+func FindPartition(device string, sel *Selector, timeout time.Duration) (*Partition, error) {
+
+	table, err := ReadPartitionTable(device)
+	if err != nil {
+		return nil, err
+	}
+	if len(table) == 0 {
+		return nil, errors.Errorf("no partition table found on %s", device)
+	}
+
+	var numbers []int
+	for _, entry := range table {
+		if sel.match(entry) {
+			numbers = append(numbers, entry.Number)
+		}
+	}
+	if len(numbers) == 0 {
+		return nil, errors.Errorf("no partition on %s matches %s", device, sel)
+	}
+
+	partitions, err := WaitPartitions(device, numbers, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, part := range partitions {
+		if part.Probe, err = ProbeDevice(part.Device); err != nil {
+			return nil, err
+		}
+		if sel.Label == "" || (part.Probe != nil && part.Probe.Label == sel.Label) {
+			return part, nil
+		}
+	}
+
+	return nil, errors.Errorf("no partition on %s matches %s", device, sel)
+}
+
+// WaitPartitions 等待指定分区号的分区设备全部出现，按分区号顺序返回
+func WaitPartitions(device string, numbers []int, timeout time.Duration) ([]*Partition, error) {
+
+	deadline := time.Now().Add(timeout)
+	for {
+		partitions, err := Partitions(device)
+		if err != nil {
+			return nil, err
+		}
+
+		found := make(map[int]*Partition)
+		for _, part := range partitions {
+			if _, err = os.Stat(part.Device); err == nil {
+				found[part.Number] = part
+			}
+		}
+
+		result := make([]*Partition, 0, len(numbers))
+		for _, number := range numbers {
+			if part, ok := found[number]; ok {
+				result = append(result, part)
+			}
+		}
+		if len(result) == len(numbers) {
+			return result, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errors.Errorf("timed out waiting for partitions %v of %s", numbers, device)
+		}
+		time.Sleep(partitionPoll)
+	}
+}
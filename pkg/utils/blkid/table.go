@@ -0,0 +1,148 @@
+package blkid
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	gptSignature   = "EFI PART"
+	mbrSignature   = 0xAA55
+	mbrProtective  = 0xEE
+	mbrTableOffset = 446
+	mbrEntries     = 4
+	// 分区表项的最大数量，防止损坏的分区表头导致读取过多数据
+	gptMaxEntries = 1024
+)
+
+// TableEntry 是分区表中的一项，MBR 分区的 TypeGUID 为十六进制的分区类型（如 0x83）
+type TableEntry struct {
+	Number   int    `json:"number"`
+	PartUUID string `json:"partuuid"`
+	TypeGUID string `json:"type"`
+	Name     string `json:"name,omitempty"`
+}
+
+// ReadPartitionTable 读取磁盘的 GPT 或 MBR 分区表，磁盘没有分区表时返回空
+func ReadPartitionTable(device string) ([]*TableEntry, error) {
+
+	f, err := os.Open(device)
+	if err != nil {
+		return nil, errors.Wrap(err, "blkid.ReadPartitionTable")
+	}
+	defer f.Close()
+
+	mbr := make([]byte, 512)
+	if _, err = io.ReadFull(f, mbr); err != nil {
+		return nil, errors.Wrapf(err, "blkid.ReadPartitionTable: read %s", device)
+	}
+	if binary.LittleEndian.Uint16(mbr[510:]) != mbrSignature {
+		return nil, nil
+	}
+
+	if mbr[mbrTableOffset+4] == mbrProtective {
+		for _, sectorSize := range []int64{512, 4096} {
+			entries, err := readGPT(f, sectorSize)
+			if err != nil {
+				return nil, errors.Wrapf(err, "blkid.ReadPartitionTable: read %s", device)
+			}
+			if entries != nil {
+				return entries, nil
+			}
+		}
+		return nil, nil
+	}
+
+	return readMBR(mbr), nil
+}
+
+func readGPT(f *os.File, sectorSize int64) ([]*TableEntry, error) {
+
+	header := make([]byte, 92)
+	if _, err := f.ReadAt(header, sectorSize); err != nil {
+		return nil, err
+	}
+	if string(header[0:8]) != gptSignature {
+		return nil, nil
+	}
+
+	entriesLBA := int64(binary.LittleEndian.Uint64(header[72:]))
+	count := binary.LittleEndian.Uint32(header[80:])
+	size := binary.LittleEndian.Uint32(header[84:])
+	if count > gptMaxEntries || size < 128 {
+		return nil, fmt.Errorf("invalid gpt header: %d entries of size %d", count, size)
+	}
+
+	buf := make([]byte, int64(count)*int64(size))
+	if _, err := f.ReadAt(buf, entriesLBA*sectorSize); err != nil {
+		return nil, err
+	}
+
+	entries := make([]*TableEntry, 0)
+	for i := uint32(0); i < count; i++ {
+		e := buf[i*size : (i+1)*size]
+		typeGUID := formatGUID(e[0:16])
+		if typeGUID == "" {
+			continue
+		}
+		entries = append(entries, &TableEntry{
+			Number:   int(i) + 1,
+			TypeGUID: typeGUID,
+			PartUUID: formatGUID(e[16:32]),
+			Name:     utf16String(e[56:128]),
+		})
+	}
+
+	return entries, nil
+}
+
+// readMBR 只读取主分区，PARTUUID 与内核相同，格式为 <磁盘签名>-<分区号>
+func readMBR(mbr []byte) []*TableEntry {
+
+	signature := binary.LittleEndian.Uint32(mbr[440:])
+
+	entries := make([]*TableEntry, 0)
+	for i := 0; i < mbrEntries; i++ {
+		e := mbr[mbrTableOffset+i*16 : mbrTableOffset+(i+1)*16]
+		if e[4] == 0 {
+			continue
+		}
+		entries = append(entries, &TableEntry{
+			Number:   i + 1,
+			TypeGUID: fmt.Sprintf("0x%02x", e[4]),
+			PartUUID: fmt.Sprintf("%08x-%02x", signature, i+1),
+		})
+	}
+
+	return entries
+}
+
+// formatGUID 按照 GUID 的混合字节序格式化，全零时返回空
+func formatGUID(b []byte) string {
+	if formatUUID(b) == "" {
+		return ""
+	}
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(b[0:4]),
+		binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]),
+		b[8:10], b[10:16])
+}
+
+func utf16String(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return strings.TrimSpace(string(utf16.Decode(u)))
+}
@@ -0,0 +1,192 @@
+package blkid
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+const (
+	linuxFSType = "0fc63daf-8483-4772-8e79-3d69d8477de4"
+	espType     = "c12a7328-f81f-11d2-ba4b-00a0c93ec93b"
+)
+
+// guidBytes 将 GUID 转换为分区表中的混合字节序
+func guidBytes(t *testing.T, guid string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(strings.ReplaceAll(guid, "-", ""))
+	if err != nil || len(b) != 16 {
+		t.Fatalf("invalid guid %s", guid)
+	}
+	out := make([]byte, 16)
+	binary.LittleEndian.PutUint32(out[0:], binary.BigEndian.Uint32(b[0:]))
+	binary.LittleEndian.PutUint16(out[4:], binary.BigEndian.Uint16(b[4:]))
+	binary.LittleEndian.PutUint16(out[6:], binary.BigEndian.Uint16(b[6:]))
+	copy(out[8:], b[8:])
+	return out
+}
+
+func writeDisk(t *testing.T, data []byte) string {
+	t.Helper()
+
+	device := path.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(device, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return device
+}
+
+// gptDisk 构造 GPT 磁盘，entries 为分区类型和 PARTUUID，类型为空的项表示未使用
+func gptDisk(t *testing.T, sectorSize int, entries [][2]string, names []string) []byte {
+	t.Helper()
+
+	disk := make([]byte, sectorSize*34)
+	binary.LittleEndian.PutUint16(disk[510:], mbrSignature)
+	disk[mbrTableOffset+4] = mbrProtective
+
+	header := disk[sectorSize:]
+	copy(header, gptSignature)
+	binary.LittleEndian.PutUint64(header[72:], 2)
+	binary.LittleEndian.PutUint32(header[80:], uint32(len(entries)))
+	binary.LittleEndian.PutUint32(header[84:], 128)
+
+	for i, e := range entries {
+		if e[0] == "" {
+			continue
+		}
+		entry := disk[2*sectorSize+i*128:]
+		copy(entry[0:16], guidBytes(t, e[0]))
+		copy(entry[16:32], guidBytes(t, e[1]))
+		for j, c := range utf16.Encode([]rune(names[i])) {
+			binary.LittleEndian.PutUint16(entry[56+2*j:], c)
+		}
+	}
+
+	return disk
+}
+
+func TestReadPartitionTable(t *testing.T) {
+
+	gptEntries := [][2]string{
+		{espType, "11111111-2222-3333-4444-555555555555"},
+		{"", ""},
+		{linuxFSType, "AAAAAAAA-BBBB-CCCC-DDDD-EEEEEEEEEEEE"},
+	}
+	gptNames := []string{"EFI System", "", "root"}
+	gptWant := []*TableEntry{
+		{Number: 1, TypeGUID: espType, PartUUID: "11111111-2222-3333-4444-555555555555", Name: "EFI System"},
+		{Number: 3, TypeGUID: linuxFSType, PartUUID: "aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee", Name: "root"},
+	}
+
+	mbr := make([]byte, 512)
+	binary.LittleEndian.PutUint16(mbr[510:], mbrSignature)
+	binary.LittleEndian.PutUint32(mbr[440:], 0x1234abcd)
+	mbr[mbrTableOffset+4] = 0x0c
+	mbr[mbrTableOffset+16*2+4] = 0x83
+
+	tests := []struct {
+		name string
+		disk []byte
+		want []*TableEntry
+	}{
+		{name: "gpt", disk: gptDisk(t, 512, gptEntries, gptNames), want: gptWant},
+		{name: "gpt 4k sectors", disk: gptDisk(t, 4096, gptEntries, gptNames), want: gptWant},
+		{name: "mbr", disk: mbr, want: []*TableEntry{
+			{Number: 1, TypeGUID: "0x0c", PartUUID: "1234abcd-01"},
+			{Number: 3, TypeGUID: "0x83", PartUUID: "1234abcd-03"},
+		}},
+		{name: "no partition table", disk: make([]byte, 4096)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := ReadPartitionTable(writeDisk(t, tt.disk))
+			if err != nil {
+				t.Fatalf("ReadPartitionTable: %v", err)
+			}
+			if !reflect.DeepEqual(entries, tt.want) {
+				t.Errorf("ReadPartitionTable() = %+v, want %+v", entries, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadPartitionTableInvalidGPT(t *testing.T) {
+
+	disk := gptDisk(t, 512, nil, nil)
+	binary.LittleEndian.PutUint32(disk[512+80:], gptMaxEntries+1)
+
+	if _, err := ReadPartitionTable(writeDisk(t, disk)); err == nil {
+		t.Fatal("ReadPartitionTable with too many entries succeeded, want error")
+	}
+}
+
+func TestSelector(t *testing.T) {
+
+	tests := []struct {
+		input string
+		want  *Selector
+		str   string
+	}{
+		{input: "2", want: &Selector{Number: 2}, str: "2"},
+		{input: "label=root", want: &Selector{Label: "root"}, str: "label=root"},
+		{input: "PARTUUID=AAAAAAAA-BBBB-CCCC-DDDD-EEEEEEEEEEEE", want: &Selector{PartUUID: "aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee"}, str: "partuuid=aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee"},
+		{input: "type=0x83", want: &Selector{TypeGUID: "0x83"}, str: "type=0x83"},
+		{input: "0"},
+		{input: "root"},
+		{input: "label="},
+		{input: "uuid=1234"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			sel, err := ParseSelector(tt.input)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("ParseSelector(%q) = %+v, want error", tt.input, sel)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseSelector(%q): %v", tt.input, err)
+			}
+			if !reflect.DeepEqual(sel, tt.want) {
+				t.Errorf("ParseSelector(%q) = %+v, want %+v", tt.input, sel, tt.want)
+			}
+			if sel.String() != tt.str {
+				t.Errorf("String() = %s, want %s", sel.String(), tt.str)
+			}
+		})
+	}
+}
+
+func TestSelectorMatch(t *testing.T) {
+
+	entry := &TableEntry{Number: 3, TypeGUID: linuxFSType, PartUUID: "aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee"}
+
+	tests := []struct {
+		sel   *Selector
+		match bool
+	}{
+		{sel: &Selector{Number: 3}, match: true},
+		{sel: &Selector{Number: 1}},
+		{sel: &Selector{PartUUID: "aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee"}, match: true},
+		{sel: &Selector{PartUUID: "11111111-2222-3333-4444-555555555555"}},
+		{sel: &Selector{TypeGUID: linuxFSType}, match: true},
+		{sel: &Selector{TypeGUID: espType}},
+		// 按卷标选择时所有分区都需要识别文件系统
+		{sel: &Selector{Label: "root"}, match: true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.sel.match(entry); got != tt.match {
+			t.Errorf("%s match = %t, want %t", tt.sel, got, tt.match)
+		}
+	}
+}
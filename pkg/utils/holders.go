@@ -0,0 +1,207 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// DeviceHolders 返回正在使用磁盘（包括其分区）的挂载点、进程和上层设备（如 device-mapper）。
+// 驱动以 hostPID 运行，通过 /proc/1/mountinfo 检查宿主机上的挂载。
+// excludeMounts 中的挂载点（如驱动自己的 staging path）和 excludePIDs 中的进程（如 qemu-nbd）不计入。
+func DeviceHolders(disk string, excludeMounts []string, excludePIDs ...int) ([]string, error) {
+
+	dev, err := filepath.EvalSymlinks(disk)
+	if err != nil {
+		return nil, errors.Wrap(err, "device holders")
+	}
+	name := filepath.Base(dev)
+
+	devices, err := blockDevices(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "device holders")
+	}
+
+	var holders []string
+
+	// 上层设备
+	for _, blk := range devices {
+		entries, err := os.ReadDir(path.Join(blk.sysPath, "holders"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrap(err, "device holders")
+		}
+		for _, entry := range entries {
+			holders = append(holders, fmt.Sprintf("%s is held by %s", blk.name, entry.Name()))
+		}
+	}
+
+	// 挂载点
+	mounts, err := mountsOf(devices, excludeMounts)
+	if err != nil {
+		return nil, errors.Wrap(err, "device holders")
+	}
+	holders = append(holders, mounts...)
+
+	// 打开设备的进程
+	procs, err := processesOf(devices, excludePIDs)
+	if err != nil {
+		return nil, errors.Wrap(err, "device holders")
+	}
+	holders = append(holders, procs...)
+
+	return holders, nil
+}
+
+type blockDevice struct {
+	name    string
+	sysPath string
+	dev     string
+	rdev    uint64
+}
+
+// blockDevices 返回磁盘及其所有分区
+func blockDevices(name string) ([]*blockDevice, error) {
+
+	sysPath := path.Join("/sys/class/block", name)
+	disk, err := newBlockDevice(name, sysPath)
+	if err != nil {
+		return nil, err
+	}
+	devices := []*blockDevice{disk}
+
+	entries, err := os.ReadDir(sysPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), name) {
+			continue
+		}
+		part := path.Join(sysPath, entry.Name())
+		if _, err = os.Stat(path.Join(part, "partition")); err != nil {
+			continue
+		}
+		blk, err := newBlockDevice(entry.Name(), part)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, blk)
+	}
+
+	return devices, nil
+}
+
+func newBlockDevice(name, sysPath string) (*blockDevice, error) {
+
+	b, err := os.ReadFile(path.Join(sysPath, "dev"))
+	if err != nil {
+		return nil, err
+	}
+	dev := strings.TrimSpace(string(b))
+
+	major, minor, ok := strings.Cut(dev, ":")
+	if !ok {
+		return nil, errors.Errorf("invalid device number %s of %s", dev, name)
+	}
+	ma, err := strconv.ParseUint(major, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	mi, err := strconv.ParseUint(minor, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	return &blockDevice{name: name, sysPath: sysPath, dev: dev, rdev: unix.Mkdev(uint32(ma), uint32(mi))}, nil
+}
+
+func mountsOf(devices []*blockDevice, excludeMounts []string) ([]string, error) {
+
+	f, err := os.Open("/proc/1/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	byDev := make(map[string]*blockDevice)
+	for _, blk := range devices {
+		byDev[blk.dev] = blk
+	}
+
+	excluded := make(map[string]bool)
+	for _, mnt := range excludeMounts {
+		excluded[filepath.Clean(mnt)] = true
+	}
+
+	var mounts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		if blk, ok := byDev[fields[2]]; ok && !excluded[filepath.Clean(fields[4])] {
+			mounts = append(mounts, fmt.Sprintf("%s is mounted on %s", blk.name, fields[4]))
+		}
+	}
+
+	return mounts, scanner.Err()
+}
+
+func processesOf(devices []*blockDevice, excludePIDs []int) ([]string, error) {
+
+	byRdev := make(map[uint64]*blockDevice)
+	for _, blk := range devices {
+		byRdev[blk.rdev] = blk
+	}
+
+	excluded := make(map[int]bool)
+	for _, pid := range excludePIDs {
+		excluded[pid] = true
+	}
+	excluded[os.Getpid()] = true
+
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	var holders []string
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil || excluded[pid] {
+			continue
+		}
+
+		fdDir := path.Join("/proc", proc.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			// 进程已经退出或者没有权限
+			continue
+		}
+
+		for _, fd := range fds {
+			st := &unix.Stat_t{}
+			if err = unix.Stat(path.Join(fdDir, fd.Name()), st); err != nil {
+				continue
+			}
+			if st.Mode&unix.S_IFMT != unix.S_IFBLK {
+				continue
+			}
+			if blk, ok := byRdev[uint64(st.Rdev)]; ok {
+				holders = append(holders, fmt.Sprintf("%s is opened by pid %d", blk.name, pid))
+				break
+			}
+		}
+	}
+
+	return holders, nil
+}
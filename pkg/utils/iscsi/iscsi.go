@@ -8,6 +8,7 @@ import (
 	"github.com/QQGoblin/extrootfs/pkg/utils/log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -18,6 +19,8 @@ import (
 	"github.com/pkg/errors"
 )
 
+const initiatorNameFile = "/etc/iscsi/initiatorname.iscsi"
+
 type Disk struct {
 	Portals         []string
 	IQN             string
@@ -103,6 +106,27 @@ func (d *Disk) SetKernalConfig() error {
 	return nil
 }
 
+// Rescan 通知内核重新读取 LUN 的容量，用于存储端扩容后刷新设备大小
+func (d *Disk) Rescan() error {
+
+	if d.DevicePath == "" {
+		return errors.New("rescan disk failed: device path is empty")
+	}
+
+	dev, err := filepath.EvalSymlinks(d.DevicePath)
+	if err != nil {
+		return errors.Wrap(err, "rescan disk failed")
+	}
+
+	rescan := filepath.Join("/sys/class/block", filepath.Base(dev), "device", "rescan")
+	log.DebugLogMsg("rescan iscsi disk %s", rescan)
+	if err = os.WriteFile(rescan, []byte("1"), 0200); err != nil {
+		return errors.Wrap(err, "rescan disk failed")
+	}
+
+	return nil
+}
+
 func (d *Disk) DetachDisk() error {
 	iscsilib.Disconnect(d.IQN, d.Portals)
 	return nil
@@ -205,6 +229,27 @@ func (s *Session) String() string {
 	return fmt.Sprintf("session name: %s,, status: Connection(%s), Session(%s)", s.Name, s.ConnectionState, s.SessionState)
 }
 
+// InitiatorName 读取节点的 iscsi initiator 名称
+func InitiatorName() (string, error) {
+
+	b, err := os.ReadFile(initiatorNameFile)
+	if err != nil {
+		return "", errors.Wrap(err, "read initiator name")
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "InitiatorName=") {
+			continue
+		}
+		if name := strings.TrimPrefix(line, "InitiatorName="); name != "" {
+			return name, nil
+		}
+	}
+
+	return "", errors.Errorf("no initiator name in %s", initiatorNameFile)
+}
+
 func sgPersistCmd(args ...string) (string, error) {
 	log.DebugLogMsg("run sg_persist with args: %s", strings.Join(args, " "))
 	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
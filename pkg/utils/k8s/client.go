@@ -0,0 +1,23 @@
+package k8s
+
+import (
+	"github.com/pkg/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// NewClient 使用 Pod 的 ServiceAccount 创建 kubernetes 客户端
+func NewClient() (kubernetes.Interface, error) {
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "load in-cluster config")
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "create kubernetes client")
+	}
+
+	return client, nil
+}
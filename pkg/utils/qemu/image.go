@@ -5,6 +5,8 @@ import (
 	"github.com/pkg/errors"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 )
 
 type ImgInfo struct {
@@ -19,6 +21,9 @@ type ImgInfo struct {
 
 	// Virtual size of the disk (e.g. 2361393152)
 	VirtualSize int64 `json:"virtual-size"`
+
+	// Absolute path of the backing file, empty if the image has no backing file
+	FullBackingFilename string `json:"full-backing-filename,omitempty"`
 }
 
 func info(name string) (*ImgInfo, error) {
@@ -51,6 +56,22 @@ func ImageInfo(name string) (*ImgInfo, error) {
 	return info(name)
 }
 
+// BackingFile 返回镜像的 backing file，使用 --force-share 读取，允许镜像正在被 qemu-nbd 使用
+func BackingFile(name string) (string, error) {
+
+	out, err := exec.Command("qemu-img", "info", "-U", "--output=json", name).Output()
+	if err != nil {
+		return "", errors.Wrap(err, "image.BackingFile")
+	}
+
+	info := &ImgInfo{}
+	if err = json.Unmarshal(out, info); err != nil {
+		return "", errors.Wrap(err, "image.BackingFile")
+	}
+
+	return info.FullBackingFilename, nil
+}
+
 func CreateImageFromBase(name, base string) (*ImgInfo, error) {
 
 	baseInfo, err := info(base)
@@ -70,3 +91,61 @@ func CreateImageFromBase(name, base string) (*ImgInfo, error) {
 
 	return info(base)
 }
+
+// ResizeImage 调整镜像的虚拟大小，镜像不能被其他进程（如 qemu-nbd）打开
+func ResizeImage(name string, size int64) error {
+
+	if _, err := os.Stat(name); err != nil {
+		return errors.Wrap(err, "image.Resize")
+	}
+
+	cmd := exec.Command("qemu-img", "resize", name, strconv.FormatInt(size, 10))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "image.Resize: %s", strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// CopyImageWithBacking 将 name 中相对 base 变化的数据复制到新的镜像 dest 中，dest 以 base 作为 backing file。
+// 使用 --force-share 读取，因此允许 name 正在被 qemu-nbd 使用，调用方需要在复制前刷新设备缓存。
+func CopyImageWithBacking(dest, name, base string) error {
+
+	baseInfo, err := info(base)
+	if err != nil {
+		return errors.Wrap(err, "image.Copy")
+	}
+
+	temp := dest + ".tmp"
+	_ = os.Remove(temp)
+
+	//qemu-img convert -U -f qcow2 -O qcow2 -B $PWD/centos-7.4.1708.qcow2 -F qcow2 rootfs snapshot.qcow2
+	cmd := exec.Command("qemu-img", "convert", "-U",
+		"-f", baseInfo.Format, "-O", baseInfo.Format,
+		"-B", base, "-F", baseInfo.Format,
+		name, temp,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		_ = os.Remove(temp)
+		return errors.Wrapf(err, "image.Copy: %s", strings.TrimSpace(string(out)))
+	}
+
+	if err = os.Rename(temp, dest); err != nil {
+		_ = os.Remove(temp)
+		return errors.Wrap(err, "image.Copy")
+	}
+
+	return nil
+}
+
+// ConvertImage 将 name 及其 backing chain 合并为独立的镜像 dest，使用 --force-share 读取
+func ConvertImage(dest, name, format string) error {
+
+	//qemu-img convert -U -O qcow2 rootfs centos-custom.qcow2
+	cmd := exec.Command("qemu-img", "convert", "-U", "-O", format, name, dest)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "image.Convert: %s", strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
@@ -27,18 +27,19 @@ var (
 	NBDConnectLock sync.Mutex
 )
 
-// Connect a given image.
-func (n *NBD) Connect(image string, format string) error {
+// Connect a given image, readOnly exports the image as a read-only device.
+func (n *NBD) Connect(image string, format string, readOnly bool) error {
 	if err := n.allocate(); err != nil {
 		return err
 	}
 
-	var cmd *exec.Cmd = exec.Command(
-		"qemu-nbd",
-		fmt.Sprintf("--format=%s", format),
-		"--connect", n.DevicePath,
-		image,
-	)
+	args := []string{fmt.Sprintf("--format=%s", format)}
+	if readOnly {
+		args = append(args, "--read-only")
+	}
+	args = append(args, "--connect", n.DevicePath, image)
+
+	var cmd *exec.Cmd = exec.Command("qemu-nbd", args...)
 
 	log.DefaultLog("Connect NBD: %s", cmd.String())
 
@@ -62,6 +63,85 @@ func (n *NBD) Connect(image string, format string) error {
 	return nil
 }
 
+// Check 检查 NBD 设备仍然由启动时的 qemu-nbd 进程导出 image
+func (n *NBD) Check(image string) error {
+
+	if n.DevicePath == "" || n.PIDFile == "" {
+		return errors.New("nbd.Check: not connected")
+	}
+
+	data, err := os.ReadFile(n.PIDFile)
+	if err != nil {
+		return errors.Wrapf(err, "nbd.Check: %s is not connected", n.DevicePath)
+	}
+
+	pid := strings.TrimSpace(string(data))
+	if pid != n.PID {
+		return errors.Errorf("nbd.Check: %s is connected by pid %s, expect %s", n.DevicePath, pid, n.PID)
+	}
+
+	if !processServes(pid, image) {
+		return errors.Errorf("nbd.Check: %s is not serving %s", n.DevicePath, image)
+	}
+
+	return nil
+}
+
+// FindNBD 查找正在导出 image 的 NBD 设备，用于接管配置文件写入前已经连接的设备
+func FindNBD(image string) (*NBD, error) {
+
+	files, err := filepath.Glob("/sys/block/nbd*")
+	if err != nil {
+		return nil, errors.Wrap(err, "nbd.Find")
+	}
+
+	for _, file := range files {
+		pidFile := filepath.Join(file, "pid")
+		data, err := os.ReadFile(pidFile)
+		if err != nil {
+			continue
+		}
+		pid := strings.TrimSpace(string(data))
+		if processServes(pid, image) {
+			return &NBD{
+				Name:       filepath.Base(file),
+				DevicePath: path.Join("/dev", filepath.Base(file)),
+				BlockPath:  file,
+				PIDFile:    pidFile,
+				PID:        pid,
+			}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// ReadOnly 判断 qemu-nbd 进程是否以只读方式导出设备
+func (n *NBD) ReadOnly() bool {
+	return processHasArg(n.PID, "--read-only", "-r")
+}
+
+// processServes 判断进程的命令行参数中是否包含 image
+func processServes(pid, image string) bool {
+	return processHasArg(pid, image)
+}
+
+// processHasArg 判断进程的命令行参数中是否包含任意一个 args
+func processHasArg(pid string, args ...string) bool {
+	cmdline, err := os.ReadFile(path.Join("/proc", pid, "cmdline"))
+	if err != nil {
+		return false
+	}
+	for _, arg := range strings.Split(string(cmdline), "\x00") {
+		for _, a := range args {
+			if arg == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Disconnect the NBD device from qemu-nbd to free it.
 func (n *NBD) Disconnect() error {
 
@@ -69,6 +149,19 @@ func (n *NBD) Disconnect() error {
 		return nil
 	}
 
+	// 设备已经断开或者被其他 qemu-nbd 进程重新使用时，不能再断开
+	if n.PID != "" {
+		data, err := os.ReadFile(n.PIDFile)
+		if err != nil {
+			log.DebugLogMsg("NBD %s is already disconnected", n.Name)
+			return nil
+		}
+		if pid := strings.TrimSpace(string(data)); pid != n.PID {
+			log.WarningLogMsg("NBD %s is connected by pid %s instead of %s, skip disconnect", n.Name, pid, n.PID)
+			return nil
+		}
+	}
+
 	log.DebugLogMsg("Disconnect NBD from %s", n.Name)
 
 	if err := exec.Command("qemu-nbd", "--disconnect", n.DevicePath).Run(); err != nil {
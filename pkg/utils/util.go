@@ -1 +1,50 @@
 package utils
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// GetBlockDeviceSize 返回块设备的大小（字节）
+func GetBlockDeviceSize(device string) (int64, error) {
+	out, err := exec.Command("blockdev", "--getsize64", device).Output()
+	if err != nil {
+		return 0, errors.Wrapf(err, "get size of %s", device)
+	}
+
+	size, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parse size of %s", device)
+	}
+
+	return size, nil
+}
+
+// AllocatedBytes 返回文件在文件系统上实际分配的空间，稀疏文件小于文件大小
+func AllocatedBytes(name string) (int64, error) {
+	st := &unix.Stat_t{}
+	if err := unix.Stat(name, st); err != nil {
+		return 0, errors.Wrapf(err, "stat %s", name)
+	}
+	return st.Blocks * 512, nil
+}
+
+// SetBlockDeviceReadOnly 设置块设备只读，等同于 BLKROSET
+func SetBlockDeviceReadOnly(device string) error {
+	if err := exec.Command("blockdev", "--setro", device).Run(); err != nil {
+		return errors.Wrapf(err, "set %s read-only", device)
+	}
+	return nil
+}
+
+// FlushBlockDevice 将块设备的脏数据刷回后端存储
+func FlushBlockDevice(device string) error {
+	if err := exec.Command("blockdev", "--flushbufs", device).Run(); err != nil {
+		return errors.Wrapf(err, "flush %s", device)
+	}
+	return nil
+}